@@ -0,0 +1,192 @@
+package cache
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/cache"
+)
+
+// heldAnswer is a new answer for name and qtype that is held back from the late cache until it
+// is acknowledged, or deadline passes. prev is the answer normal clients get meanwhile.
+type heldAnswer struct {
+	name     string
+	qtype    uint16
+	deadline time.Time
+	prev     *item
+}
+
+// hold holds back the new answer i for key from the late cache, which still has the item li, if
+// acknowledgements are required. The hold ends at the latest c.ackHold after li expires.
+func (c *Cache) hold(key uint64, i, li *item) {
+	if c.ackHold <= 0 {
+		return
+	}
+	c.heldMu.Lock()
+	defer c.heldMu.Unlock()
+	if _, ok := c.held[key]; ok {
+		return
+	}
+	c.held[key] = &heldAnswer{
+		name:     i.Name,
+		qtype:    i.QType,
+		deadline: li.stored.Add(time.Duration(li.origTTL)*time.Second + c.ackHold),
+		prev:     li,
+	}
+}
+
+// isHeld returns whether the answer for key is held back from the late cache at now, and until
+// when. A hold that passed its deadline is released.
+func (c *Cache) isHeld(key uint64, now time.Time) (time.Time, bool) {
+	if c.ackHold <= 0 {
+		return time.Time{}, false
+	}
+	c.heldMu.Lock()
+	defer c.heldMu.Unlock()
+	h, ok := c.held[key]
+	if !ok {
+		return time.Time{}, false
+	}
+	if !now.Before(h.deadline) {
+		c.releaseHeld(key, h)
+		return time.Time{}, false
+	}
+	return h.deadline, true
+}
+
+// releaseHeld releases the hold h for key that passed its deadline. c.heldMu must be held.
+func (c *Cache) releaseHeld(key uint64, h *heldAnswer) {
+	delete(c.held, key)
+	ackTimeouts.Inc()
+	log.Warningf("New answer for %s not acknowledged within %s, releasing it to normal clients", h.name, c.ackHold)
+}
+
+// sweepHeld releases the holds that passed their deadline at now, also of names that are not
+// queried again. It returns the number of released holds.
+func (c *Cache) sweepHeld(now time.Time) int {
+	c.heldMu.Lock()
+	defer c.heldMu.Unlock()
+	n := 0
+	for key, h := range c.held {
+		if !now.Before(h.deadline) {
+			c.releaseHeld(key, h)
+			n++
+		}
+	}
+	return n
+}
+
+// startHeldSweep starts releasing the holds that passed their deadline every c.ackHold.
+func (c *Cache) startHeldSweep() {
+	stop, done := make(chan struct{}), make(chan struct{})
+	c.heldStop, c.heldDone = stop, done
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(c.ackHold)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				c.sweepHeld(c.now())
+			}
+		}
+	}()
+}
+
+// stopHeldSweep stops releasing the holds that passed their deadline, if started.
+func (c *Cache) stopHeldSweep() {
+	if c.heldStop == nil {
+		return
+	}
+	close(c.heldStop)
+	<-c.heldDone
+	c.heldStop = nil
+}
+
+// dropHeld removes the holds of which the previous answer matches, e.g. because it was purged.
+func (c *Cache) dropHeld(match func(*item) bool) {
+	c.heldMu.Lock()
+	defer c.heldMu.Unlock()
+	for key, h := range c.held {
+		if h.prev != nil && match(h.prev) {
+			delete(c.held, key)
+		}
+	}
+}
+
+// extendHeld returns a copy of the expired late item li for key that is valid until the end of
+// the hold of the new answer, and stores it in lc, if the new answer is held.
+func (c *Cache) extendHeld(lc *cache.Cache, key uint64, li *item, now time.Time) *item {
+	deadline, held := c.isHeld(key, now)
+	if !held {
+		return nil
+	}
+	ext := *li
+	ext.origTTL = uint32(deadline.Sub(li.stored).Seconds())
+	lc.Add(key, &ext)
+	return &ext
+}
+
+// heldPrevious returns the previous answer for key, valid until the end of the hold, and stores it
+// in the late cache again, if the new answer for key is held for clients with lead. It is used
+// when the late cache no longer has the previous answer, e.g. because it was evicted. Only the
+// answers of normal clients are held.
+func (c *Cache) heldPrevious(key uint64, lead time.Duration, now time.Time) *item {
+	if lead != 0 {
+		return nil
+	}
+	c.heldMu.Lock()
+	h, ok := c.held[key]
+	c.heldMu.Unlock()
+	if !ok || h.prev == nil {
+		return nil
+	}
+	lc := c.latepcache
+	if h.prev.denial() && c.latencache != nil {
+		lc = c.latencache
+	}
+	return c.extendHeld(lc, key, h.prev, now)
+}
+
+// ack releases the held answers for name and qtype, and copies them to the late cache. If records
+// is not empty, only answers with these records are released. It returns the number of released
+// answers.
+func (c *Cache) ack(name string, qtype uint16, records []string) int {
+	now := c.now()
+	if len(records) > 0 {
+		records = append([]string(nil), records...)
+		sort.Strings(records)
+	}
+
+	c.heldMu.Lock()
+	keys := []uint64{}
+	for key, h := range c.held {
+		if h.qtype != qtype || !strings.EqualFold(h.name, name) {
+			continue
+		}
+		if len(records) > 0 {
+			if i := c.earlyItem(key); i == nil || !equalStrings(rrData(i.Answer), records) {
+				continue
+			}
+		}
+		delete(c.held, key)
+		keys = append(keys, key)
+	}
+	c.heldMu.Unlock()
+
+	for _, key := range keys {
+		i := c.earlyItem(key)
+		if i == nil {
+			continue
+		}
+		c.latepcache.Remove(key)
+		if c.latencache != nil {
+			c.latencache.Remove(key)
+		}
+		c.copyToLate(key, i, now, "")
+	}
+	return len(keys)
+}
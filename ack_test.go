@@ -0,0 +1,216 @@
+package cache
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/delta10/k8s_cache/feed"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func TestAckHold(t *testing.T) {
+	tests := []struct {
+		futureSeconds int
+		w             dns.ResponseWriter
+		ack           bool // Acknowledge the current answer before the query
+		ip            string
+		ttl           uint32
+	}{
+		{0, &test.ResponseWriter6{}, false, "127.0.0.1", 15}, // Late cache valid until 15s
+		{11, &test.ResponseWriter{}, false, "127.0.0.2", 10}, // Changed, held until 25s
+		{16, &test.ResponseWriter6{}, false, "127.0.0.1", 9}, // Previous answer while held
+		{20, &test.ResponseWriter6{}, false, "127.0.0.1", 5},
+		{21, &test.ResponseWriter6{}, true, "127.0.0.2", 5}, // Acknowledged, late item for the new answer
+	}
+	ctx := context.TODO()
+	c := newTestK8sCache(true)
+	c.ackHold = 10 * time.Second
+	c.Next = addressBackend("127.0.0.1", 10)
+	start := time.Now()
+	for i, tt := range tests {
+		c.now = func() time.Time { return start.Add(time.Duration(tt.futureSeconds) * time.Second) }
+		if tt.futureSeconds == 11 {
+			c.Next = addressBackend("127.0.0.2", 10)
+		}
+		if tt.ack {
+			if n := c.ack("example.org.", dns.TypeA, []string{tt.ip}); n != 1 {
+				t.Errorf("Test %d: expected 1 acknowledged answer, got %d", i, n)
+			}
+		}
+		req := new(dns.Msg)
+		req.SetQuestion("example.org.", dns.TypeA)
+		rec := dnstest.NewRecorder(tt.w)
+		c.ServeDNS(ctx, rec, req)
+
+		a := rec.Msg.Answer[0].(*dns.A)
+		if a.A.String() != tt.ip || a.Hdr.Ttl != tt.ttl {
+			t.Errorf("Test %d: expected %s with TTL %d, got %s with TTL %d", i, tt.ip, tt.ttl, a.A, a.Hdr.Ttl)
+		}
+	}
+}
+
+func TestAckHoldTimeout(t *testing.T) {
+	ctx := context.TODO()
+	c := newTestK8sCache(true)
+	c.ackHold = 10 * time.Second
+	start := time.Now()
+	timeouts := testutil.ToFloat64(ackTimeouts)
+
+	for _, q := range []struct {
+		futureSeconds int
+		w             dns.ResponseWriter
+		ip            string
+	}{
+		{0, &test.ResponseWriter6{}, "127.0.0.1"},
+		{11, &test.ResponseWriter{}, "127.0.0.2"},
+		{16, &test.ResponseWriter6{}, "127.0.0.1"}, // Held until 25s
+		{26, &test.ResponseWriter6{}, "127.0.0.2"}, // Released without acknowledgement
+	} {
+		c.now = func() time.Time { return start.Add(time.Duration(q.futureSeconds) * time.Second) }
+		c.Next = addressBackend("127.0.0.2", 10)
+		if q.futureSeconds == 0 {
+			c.Next = addressBackend("127.0.0.1", 10)
+		}
+		req := new(dns.Msg)
+		req.SetQuestion("example.org.", dns.TypeA)
+		rec := dnstest.NewRecorder(q.w)
+		c.ServeDNS(ctx, rec, req)
+		if ip := rec.Msg.Answer[0].(*dns.A).A.String(); ip != q.ip {
+			t.Errorf("At %ds: expected %s, got %s", q.futureSeconds, q.ip, ip)
+		}
+	}
+	if n := testutil.ToFloat64(ackTimeouts) - timeouts; n != 1 {
+		t.Errorf("Expected 1 acknowledgement timeout, got %v", n)
+	}
+}
+
+func TestAckHoldEvicted(t *testing.T) {
+	ctx := context.TODO()
+	c := newTestK8sCache(true)
+	c.ackHold = 10 * time.Second
+	start := time.Now()
+	key := hash("example.org.", dns.TypeA, false, false)
+
+	for _, q := range []struct {
+		futureSeconds int
+		w             dns.ResponseWriter
+		evict         bool // Remove the item from the late cache before the query
+		ip            string
+		ttl           uint32
+	}{
+		{0, &test.ResponseWriter6{}, false, "127.0.0.1", 15},
+		{11, &test.ResponseWriter{}, false, "127.0.0.2", 10}, // Changed, held until 25s
+		{16, &test.ResponseWriter6{}, true, "127.0.0.1", 9},  // Previous answer, not the held one
+		{17, &test.ResponseWriter6{}, false, "127.0.0.1", 8},
+	} {
+		c.now = func() time.Time { return start.Add(time.Duration(q.futureSeconds) * time.Second) }
+		c.Next = addressBackend("127.0.0.2", 10)
+		if q.futureSeconds == 0 {
+			c.Next = addressBackend("127.0.0.1", 10)
+		}
+		if q.evict {
+			c.latepcache.Remove(key)
+		}
+		req := new(dns.Msg)
+		req.SetQuestion("example.org.", dns.TypeA)
+		rec := dnstest.NewRecorder(q.w)
+		c.ServeDNS(ctx, rec, req)
+		a := rec.Msg.Answer[0].(*dns.A)
+		if a.A.String() != q.ip || a.Hdr.Ttl != q.ttl {
+			t.Errorf("At %ds: expected %s with TTL %d, got %s with TTL %d", q.futureSeconds, q.ip, q.ttl, a.A, a.Hdr.Ttl)
+		}
+	}
+
+	// A purge drops the hold, so the previous answer isn't served again
+	if n := c.purge(func(i *item) bool { return true }); n == 0 {
+		t.Fatalf("Expected purged items")
+	}
+	if _, held := c.isHeld(key, c.now()); held {
+		t.Errorf("Expected hold to be dropped by the purge")
+	}
+}
+
+func TestAckHoldSweep(t *testing.T) {
+	c := newTestK8sCache(true)
+	c.ackHold = 10 * time.Second
+	start := time.Now()
+	li := &item{Name: "example.org.", QType: dns.TypeA, origTTL: 5, stored: start}
+	c.hold(1, &item{Name: "example.org.", QType: dns.TypeA}, li) // Held until 15s
+	timeouts := testutil.ToFloat64(ackTimeouts)
+
+	if n := c.sweepHeld(start.Add(14 * time.Second)); n != 0 {
+		t.Errorf("Expected no released holds before the deadline, got %d", n)
+	}
+	if n := c.sweepHeld(start.Add(15 * time.Second)); n != 1 {
+		t.Errorf("Expected 1 released hold at the deadline, got %d", n)
+	}
+	if len(c.held) != 0 {
+		t.Errorf("Expected no holds left, got %d", len(c.held))
+	}
+	if n := testutil.ToFloat64(ackTimeouts) - timeouts; n != 1 {
+		t.Errorf("Expected 1 acknowledgement timeout, got %v", n)
+	}
+}
+
+func TestAckFeed(t *testing.T) {
+	c := newTestK8sCache(true)
+	c.ackHold = time.Minute
+	c.feed = newFeedServer(c, "127.0.0.1:0")
+	c.feed.token = []byte("secret")
+	c.held[1] = &heldAnswer{name: "example.org.", qtype: dns.TypeA, deadline: time.Now().Add(time.Minute)}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := feed.NewServer(c.feed)
+	go s.Serve(ln)
+	defer s.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, token := range []string{"", "wrong"} {
+		opts := []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+		if token != "" {
+			opts = append(opts, grpc.WithPerRPCCredentials(feed.Token(token)))
+		}
+		client, err := feed.NewClient(ln.Addr().String(), opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Ack(ctx, "example.org", "A"); status.Code(err) != codes.Unauthenticated {
+			t.Errorf("Expected unauthenticated error for token %q, got %v", token, err)
+		}
+		client.Close()
+	}
+
+	client, err := feed.NewClient(ln.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithPerRPCCredentials(feed.Token("secret")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if _, err := client.Ack(ctx, "example.org", "BOGUS"); err == nil {
+		t.Errorf("Expected error for unknown qtype")
+	}
+	if n, err := client.Ack(ctx, "example.org", "AAAA"); err != nil || n != 0 {
+		t.Errorf("Expected no acknowledged answers for AAAA, got %d: %v", n, err)
+	}
+	if n, err := client.Ack(ctx, "Example.org", "a"); err != nil || n != 1 {
+		t.Errorf("Expected 1 acknowledged answer, got %d: %v", n, err)
+	}
+	if _, held := c.isHeld(1, time.Now()); held {
+		t.Errorf("Expected answer to be released")
+	}
+}
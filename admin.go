@@ -0,0 +1,193 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+
+	"github.com/miekg/dns"
+)
+
+const adminPath = "/v1/cache"
+
+// adminEntry is the state of a key in the caches, as shown by the admin API. Early is the item
+// in the early cache, Late the item in the late cache for normal clients, and Leads the items in
+// the late caches for early refresh pods with a shorter lead.
+type adminEntry struct {
+	Key   uint64                `json:"key"`
+	Name  string                `json:"name"`
+	QType string                `json:"qtype"`
+	Early *adminItem            `json:"early,omitempty"`
+	Late  *adminItem            `json:"late,omitempty"`
+	Leads map[string]*adminItem `json:"leads,omitempty"`
+}
+
+// adminItem is a single cache item. TTL is the remaining TTL in seconds, and negative if the
+// item is stale.
+type adminItem struct {
+	Cache  string    `json:"cache"` // Success or Denial
+	Rcode  string    `json:"rcode"`
+	TTL    int       `json:"ttl"`
+	Stored time.Time `json:"stored"`
+	Answer []string  `json:"answer,omitempty"`
+}
+
+func newAdminItem(i *item, typ string, now time.Time) *adminItem {
+	ai := &adminItem{
+		Cache:  typ,
+		Rcode:  dns.RcodeToString[i.Rcode],
+		TTL:    i.ttl(now),
+		Stored: i.stored,
+	}
+	for _, rr := range i.Answer {
+		ai.Answer = append(ai.Answer, rr.String())
+	}
+	return ai
+}
+
+// startAdmin starts the admin API listener on c.adminAddr.
+func (c *Cache) startAdmin() error {
+	token, err := os.ReadFile(c.adminTokenFile)
+	if err != nil {
+		return err
+	}
+	c.adminToken = bytes.TrimSpace(token)
+	if len(c.adminToken) == 0 {
+		return errors.New("admin token file " + c.adminTokenFile + " is empty")
+	}
+	ln, err := net.Listen("tcp", c.adminAddr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle(adminPath, c.adminHandler())
+	s := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	done := make(chan struct{})
+	c.adminServer, c.adminDone = s, done
+	go func() {
+		defer close(done)
+		if err := s.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Admin listener on %s failed: %s", c.adminAddr, err)
+		}
+	}()
+	return nil
+}
+
+// stopAdmin stops the admin API listener, if started.
+func (c *Cache) stopAdmin() {
+	if c.adminServer != nil {
+		c.adminServer.Close()
+		// The listener is only closed once Serve returns
+		<-c.adminDone
+		c.adminServer = nil
+	}
+}
+
+// adminHandler returns the HTTP handler of the admin API. GET lists the entries, and DELETE
+// purges them. Both take a name parameter to select a single name, or a zone parameter to
+// select all names in a zone. GET without parameters lists everything, and DELETE requires the
+// all parameter to purge everything. Requests must present the token of the admin API.
+func (c *Cache) adminHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		auth := []byte(strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "))
+		if len(c.adminToken) == 0 || subtle.ConstantTimeCompare(auth, c.adminToken) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		q := req.URL.Query()
+		match, ok := nameMatch(q.Get("name"), q.Get("zone"))
+
+		switch req.Method {
+		case http.MethodGet:
+			writeJSON(w, c.entries(match))
+		case http.MethodDelete:
+			if !ok && !q.Has("all") {
+				http.Error(w, "name, zone or all parameter required", http.StatusBadRequest)
+				return
+			}
+			n := c.purge(match)
+			log.Infof("Purged %d cache items through the admin API", n)
+			writeJSON(w, struct {
+				Removed int `json:"removed"`
+			}{n})
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// nameMatch returns a function matching items for name, or for all names in zone if name is
+// empty. If both are empty, all items match and false is returned.
+func nameMatch(name, zone string) (func(*item) bool, bool) {
+	switch {
+	case name != "":
+		name = dns.Fqdn(name)
+		return func(i *item) bool { return strings.EqualFold(i.Name, name) }, true
+	case zone != "":
+		zone = plugin.Name(dns.Fqdn(zone)).Normalize()
+		return func(i *item) bool { return plugin.Name(zone).Matches(i.Name) }, true
+	}
+	return func(*item) bool { return true }, false
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warningf("Failed to write admin API response: %s", err)
+	}
+}
+
+// entries returns the entries for all items matching match, ordered as found.
+func (c *Cache) entries(match func(*item) bool) []*adminEntry {
+	now := c.now()
+	entries := []*adminEntry{}
+	byKey := make(map[uint64]*adminEntry)
+	for _, sc := range c.snapshotCaches() {
+		keys, items := walkItems(sc.cache, match)
+		for j, i := range items {
+			e, ok := byKey[keys[j]]
+			if !ok {
+				e = &adminEntry{Key: keys[j], Name: i.Name, QType: dns.TypeToString[i.QType]}
+				byKey[keys[j]] = e
+				entries = append(entries, e)
+			}
+			ai := newAdminItem(i, sc.typ, now)
+			switch {
+			case !sc.late:
+				e.Early = ai
+			case sc.lead == 0:
+				e.Late = ai
+			default:
+				if e.Leads == nil {
+					e.Leads = make(map[string]*adminItem)
+				}
+				e.Leads[sc.lead.String()] = ai
+			}
+		}
+	}
+	return entries
+}
+
+// purge removes all items matching match from the early and late caches, and returns the
+// number of removed items.
+func (c *Cache) purge(match func(*item) bool) int {
+	// Purged names are resolved again instead of serving their previous answer while held
+	c.dropHeld(match)
+	n := 0
+	for _, sc := range c.snapshotCaches() {
+		keys, _ := walkItems(sc.cache, match)
+		for _, key := range keys {
+			sc.cache.Remove(key)
+		}
+		n += len(keys)
+	}
+	return n
+}
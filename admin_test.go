@@ -0,0 +1,199 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+// newTestAdmin returns a cache with a few names cached, and an admin API server for it.
+func newTestAdmin(t *testing.T) (*Cache, *httptest.Server) {
+	c := newTestK8sCache(true)
+	ctx := context.TODO()
+	for _, q := range []struct {
+		qname   string
+		backend plugin.Handler
+	}{
+		{"example.org.", ttlBackend(60)},
+		{"www.example.org.", ttlBackend(60)},
+		{"example.net.", ttlBackend(60)},
+		{"nx.example.org.", nxDomainBackend(30)},
+	} {
+		c.Next = q.backend
+		req := new(dns.Msg)
+		req.SetQuestion(q.qname, dns.TypeA)
+		c.ServeDNS(ctx, dnstest.NewRecorder(&test.ResponseWriter6{}), req)
+	}
+	c.adminToken = []byte("secret")
+	s := httptest.NewServer(c.adminHandler())
+	t.Cleanup(s.Close)
+	return c, s
+}
+
+// freeAddr returns a local address that is free to listen on.
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func adminRequest(t *testing.T, method, url string, v interface{}) int {
+	return adminRequestToken(t, method, url, "secret", v)
+}
+
+func adminRequestToken(t *testing.T, method, url, token string, v interface{}) int {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK && v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestAdminList(t *testing.T) {
+	_, s := newTestAdmin(t)
+
+	entries := []*adminEntry{}
+	adminRequest(t, http.MethodGet, s.URL+adminPath, &entries)
+	if len(entries) != 4 {
+		t.Fatalf("Expected 4 entries, got %d", len(entries))
+	}
+
+	entries = nil
+	adminRequest(t, http.MethodGet, s.URL+adminPath+"?name=Example.org", &entries)
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 entry for example.org., got %d", len(entries))
+	}
+	e := entries[0]
+	if e.Name != "example.org." || e.QType != "A" {
+		t.Errorf("Expected entry for example.org. A, got %s %s", e.Name, e.QType)
+	}
+	if e.Early == nil || e.Early.TTL != 60 || e.Early.Rcode != "NOERROR" || len(e.Early.Answer) != 1 {
+		t.Errorf("Expected early item with TTL 60 and one answer, got %+v", e.Early)
+	}
+	if e.Late == nil || e.Late.TTL != 65 {
+		t.Errorf("Expected late item with TTL 65, got %+v", e.Late)
+	}
+
+	entries = nil
+	adminRequest(t, http.MethodGet, s.URL+adminPath+"?name=nx.example.org.", &entries)
+	if len(entries) != 1 || entries[0].Early == nil || entries[0].Early.Cache != Denial || entries[0].Late != nil {
+		t.Errorf("Expected nx.example.org. to be a denial in the early cache only, got %+v", entries)
+	}
+}
+
+func TestAdminPurge(t *testing.T) {
+	tests := []struct {
+		query     string
+		status    int
+		removed   int
+		remaining int
+	}{
+		{"", http.StatusBadRequest, 0, 4},
+		{"?name=www.example.org.", http.StatusOK, 2, 3},
+		{"?name=missing.example.org.", http.StatusOK, 0, 4},
+		{"?zone=example.org", http.StatusOK, 5, 1},
+		{"?zone=.", http.StatusOK, 7, 0},
+		{"?all", http.StatusOK, 7, 0},
+	}
+	for i, tt := range tests {
+		c, s := newTestAdmin(t)
+		var resp struct {
+			Removed int `json:"removed"`
+		}
+		if status := adminRequest(t, http.MethodDelete, s.URL+adminPath+tt.query, &resp); status != tt.status {
+			t.Errorf("Test %d: expected status %d, got %d", i, tt.status, status)
+		}
+		if resp.Removed != tt.removed {
+			t.Errorf("Test %d: expected %d removed items, got %d", i, tt.removed, resp.Removed)
+		}
+		if n := len(c.entries(func(*item) bool { return true })); n != tt.remaining {
+			t.Errorf("Test %d: expected %d remaining entries, got %d", i, tt.remaining, n)
+		}
+	}
+}
+
+func TestAdminToken(t *testing.T) {
+	tests := []struct {
+		method string
+		query  string
+		token  string
+		status int
+	}{
+		{http.MethodGet, "", "", http.StatusUnauthorized},
+		{http.MethodGet, "", "wrong", http.StatusUnauthorized},
+		{http.MethodDelete, "?all", "", http.StatusUnauthorized},
+		{http.MethodDelete, "?all", "wrong", http.StatusUnauthorized},
+		{http.MethodGet, "", "secret", http.StatusOK},
+	}
+	for i, tt := range tests {
+		c, s := newTestAdmin(t)
+		if status := adminRequestToken(t, tt.method, s.URL+adminPath+tt.query, tt.token, nil); status != tt.status {
+			t.Errorf("Test %d: expected status %d, got %d", i, tt.status, status)
+		}
+		if n := len(c.entries(func(*item) bool { return true })); n != 4 {
+			t.Errorf("Test %d: expected 4 entries, got %d", i, n)
+		}
+	}
+}
+
+func TestAdminTokenFile(t *testing.T) {
+	c := newTestK8sCache(false)
+	c.adminAddr = freeAddr(t)
+	c.adminTokenFile = filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(c.adminTokenFile, []byte("\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.startAdmin(); err == nil {
+		c.stopAdmin()
+		t.Fatal("Expected error for an empty token file")
+	}
+	c.adminTokenFile = filepath.Join(t.TempDir(), "missing")
+	if err := c.startAdmin(); err == nil {
+		c.stopAdmin()
+		t.Fatal("Expected error for a missing token file")
+	}
+}
+
+func TestAdminRestart(t *testing.T) {
+	c := newTestK8sCache(false)
+	c.adminAddr = freeAddr(t)
+	c.adminTokenFile = filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(c.adminTokenFile, []byte("secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < 2; n++ {
+		// A reload stops the listener, and starts it again if the new instance fails
+		if err := c.startAdmin(); err != nil {
+			t.Fatalf("Start %d: %s", n, err)
+		}
+		c.stopAdmin()
+	}
+	c.stopAdmin()
+}
@@ -4,6 +4,7 @@ package cache
 import (
 	"hash/fnv"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/coredns/coredns/plugin"
@@ -41,8 +42,9 @@ type CacheBackend struct {
 	percentage int
 
 	// Stale serve
-	staleUpTo   time.Duration
-	verifyStale bool
+	staleUpTo    time.Duration
+	verifyStale  bool
+	staleTimeout time.Duration // RFC 8767 client response timer for verify mode
 
 	// Positive/negative zone exceptions
 	pexcept []string
@@ -138,6 +140,7 @@ type ResponseWriter struct {
 	cd         bool // When true the original request had the CD bit set.
 	ad         bool // When true the original request had the AD bit set.
 	prefetch   bool // When true write nothing back to the client.
+	shared     bool // When true the reply was shared by a concurrent upstream query, and is not cached again.
 	remoteAddr net.Addr
 
 	wildcardFunc func() string // function to retrieve wildcard name that synthesized the result.
@@ -197,7 +200,7 @@ func (w *ResponseWriter) WriteMsg(res *dns.Msg) error {
 		duration = computeTTL(msgTTL, w.minpttl, w.pttl)
 	}
 
-	if hasKey && duration > 0 {
+	if hasKey && duration > 0 && !w.shared {
 		if w.state.Match(res) {
 			w.set(res, key, mt, duration)
 			cacheSize.WithLabelValues(w.server, Success, w.zonesMetricLabel, w.viewMetricLabel).Set(float64(w.pcache.Len()))
@@ -213,9 +216,11 @@ func (w *ResponseWriter) WriteMsg(res *dns.Msg) error {
 	}
 
 	// Apply capped TTL to this reply to avoid jarring TTL experience 1799 -> 8 (e.g.)
+	// Clients get positive answers later, and so with a longer TTL, the shorter their lead is
 	var ttl uint32
-	if !w.NeedEarlyRefresh(w.state) && (mt == response.NoError || mt == response.Delegation) {
-		ttl = uint32(duration.Seconds()) + uint32(w.extrattl.Seconds())
+	if mt == response.NoError || mt == response.Delegation {
+		lead, _ := w.earlyRefreshLead(w.state)
+		ttl = uint32(duration.Seconds()) + uint32((w.extraTTL(w.state.Name()) - lead).Seconds())
 	} else {
 		ttl = uint32(duration.Seconds())
 	}
@@ -245,10 +250,16 @@ func (w *ResponseWriter) set(m *dns.Msg, key uint64, mt response.Type, duration
 		if w.wildcardFunc != nil {
 			i.wildcard = w.wildcardFunc()
 		}
+		prev := w.earlyItem(key)
 		if w.pcache.Add(key, i) {
 			evictions.WithLabelValues(w.server, Success, w.zonesMetricLabel, w.viewMetricLabel).Inc()
 		}
-		w.copyToLate(key, i, w.now())
+		if li := w.detectChange(key, prev, i, w.now(), w.server); li != nil {
+			w.hold(key, i, li)
+		}
+		w.copyToLate(key, i, w.now(), w.server)
+		w.replicate(key, i, Success)
+		w.publish(i)
 		// when pre-fetching, remove the negative cache entry if it exists
 		if w.prefetch {
 			w.ncache.Remove(key)
@@ -263,9 +274,18 @@ func (w *ResponseWriter) set(m *dns.Msg, key uint64, mt response.Type, duration
 		if w.wildcardFunc != nil {
 			i.wildcard = w.wildcardFunc()
 		}
+		prev := w.earlyItem(key)
 		if w.ncache.Add(key, i) {
 			evictions.WithLabelValues(w.server, Denial, w.zonesMetricLabel, w.viewMetricLabel).Inc()
 		}
+		if w.latedenial {
+			if li := w.detectChange(key, prev, i, w.now(), w.server); li != nil {
+				w.hold(key, i, li)
+			}
+		}
+		w.copyToLate(key, i, w.now(), w.server)
+		w.replicate(key, i, Denial)
+		w.publish(i)
 
 	case response.OtherError:
 		// don't cache these
@@ -311,6 +331,51 @@ func (w *verifyStaleResponseWriter) WriteMsg(res *dns.Msg) error {
 	return nil // else discard
 }
 
+// staleTimerResponseWriter is a verifyStaleResponseWriter for refreshes that may outlive the client
+// response timer of RFC8767, section 5. Once the client got the stale answer, a refreshed answer is
+// only stored to the cache.
+type staleTimerResponseWriter struct {
+	*ResponseWriter
+	done chan struct{} // closed when the refresh is done.
+
+	mu        sync.Mutex
+	refreshed bool // set to true if the refreshed answer was sent to the client.
+	timedOut  bool // set to true if the client gets the stale answer.
+}
+
+// newStaleTimerResponseWriter returns a ResponseWriter to be used when verifying stale cache entries
+// with a client response timer.
+func newStaleTimerResponseWriter(w *ResponseWriter) *staleTimerResponseWriter {
+	return &staleTimerResponseWriter{
+		ResponseWriter: w,
+		done:           make(chan struct{}),
+	}
+}
+
+// WriteMsg implements the dns.ResponseWriter interface.
+func (w *staleTimerResponseWriter) WriteMsg(res *dns.Msg) error {
+	if res.Rcode != dns.RcodeSuccess && res.Rcode != dns.RcodeNameError {
+		return nil // discard
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timedOut {
+		w.ResponseWriter.prefetch = true // only store to the cache
+	} else {
+		w.refreshed = true
+	}
+	return w.ResponseWriter.WriteMsg(res)
+}
+
+// timeout returns whether the client should get the stale answer, because the refresh didn't
+// send a refreshed answer to the client yet. Later refreshed answers are only stored to the cache.
+func (w *staleTimerResponseWriter) timeout() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.timedOut = !w.refreshed
+	return w.timedOut
+}
+
 const (
 	maxTTL  = dnsutil.MaximumDefaulTTL
 	minTTL  = dnsutil.MinimalDefaultTTL
@@ -8,6 +8,7 @@ import (
 
 	"github.com/coredns/coredns/plugin"
 	"github.com/coredns/coredns/plugin/metadata"
+	"github.com/coredns/coredns/plugin/pkg/cache"
 	"github.com/coredns/coredns/plugin/pkg/dnstest"
 	"github.com/coredns/coredns/plugin/pkg/response"
 	"github.com/coredns/coredns/plugin/test"
@@ -17,7 +18,6 @@ import (
 
 	"k8s.io/client-go/kubernetes/fake"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	kcache "k8s.io/client-go/tools/cache"
 	"k8s.io/api/core/v1"
 )
 
@@ -36,22 +36,9 @@ func cacheMsg(m *dns.Msg, tc test.Case) *dns.Msg {
 
 func newTestK8sCache(earlyRefresh bool) *Cache {
 	c := New()
-	k := new(k8sAPI)
-	var clientset *fake.Clientset
-
-	clientset = fake.NewSimpleClientset()
-
-	optionsModifier := func(options *metav1.ListOptions) {
-		options.LabelSelector = "k8s-cache.coredns.io/early-refresh=true"
-	}
-	lw := kcache.NewFilteredListWatchFromClient(
-		clientset.CoreV1().RESTClient(),
-		"pods",
-		metav1.NamespaceAll,
-		optionsModifier,
-	)
-
-	k.store, k.reflector = kcache.NewNamespaceKeyedIndexerAndReflector(lw, &v1.Pod{}, time.Second*10)
+	k := newK8sAPI()
+	k.client = fake.NewSimpleClientset()
+	k.podWatchers[metav1.NamespaceAll] = k.newPodWatcher(metav1.NamespaceAll)
 
 	if earlyRefresh {
 		c.extrattl = time.Duration(5)*time.Second
@@ -64,12 +51,13 @@ func newTestK8sCache(earlyRefresh bool) *Cache {
 				},
 			},
 			Status: v1.PodStatus{
+				Phase: v1.PodRunning,
 				PodIPs: []v1.PodIP{
 					{IP: "10.240.0.1"},
 				},
 			},
 		}
-		k.store.Add(selfPod)
+		k.podWatchers[metav1.NamespaceAll].store.Add(selfPod)
 	}
 
 	c.k8sAPI = k
@@ -564,6 +552,56 @@ func TestServeFromStaleCacheFetchVerify(t *testing.T) {
 	}
 }
 
+func TestServeFromStaleCacheClientTimeout(t *testing.T) {
+	c := newTestK8sCache(false)
+	c.staleUpTo = 1 * time.Hour
+	c.verifyStale = true
+	c.staleTimeout = 50 * time.Millisecond
+	c.Next = addressBackend("127.0.0.1", 60)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	ctx := context.TODO()
+	c.ServeDNS(ctx, dnstest.NewRecorder(&test.ResponseWriter{}), req.Copy())
+
+	tests := []struct {
+		futureMinutes int
+		slow          bool // Upstream answers after the client response timer
+		ip            string
+		expectedIP    string
+		expectedTtl   uint32
+	}{
+		{2, true, "127.0.0.2", "127.0.0.1", 0},
+		{4, false, "127.0.0.3", "127.0.0.3", 60},
+	}
+	for i, tt := range tests {
+		c.now = func() time.Time { return time.Now().Add(time.Duration(tt.futureMinutes) * time.Minute) }
+		release := make(chan struct{})
+		next := addressBackend(tt.ip, 60)
+		c.Next = plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+			if tt.slow {
+				<-release
+			}
+			return next.ServeDNS(ctx, w, r)
+		})
+
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		c.ServeDNS(ctx, rec, req.Copy())
+		close(release)
+		a := rec.Msg.Answer[0].(*dns.A)
+		if a.A.String() != tt.expectedIP || a.Hdr.Ttl != tt.expectedTtl {
+			t.Errorf("Test %d: expected %s with TTL %d, got %s with TTL %d", i, tt.expectedIP, tt.expectedTtl, a.A, a.Hdr.Ttl)
+		}
+
+		// The refresh updates the cache, also after the client got the stale answer
+		state := request.Request{W: &test.ResponseWriter{}, Req: req}
+		waitFor(t, "refreshed answer in the cache", func() bool {
+			itm := c.exists(state)
+			return itm != nil && itm.Answer[0].(*dns.A).A.String() == tt.ip
+		})
+	}
+}
+
 func TestNegativeStaleMaskingPositiveCache(t *testing.T) {
 	c := newTestK8sCache(true)
 	c.staleUpTo = time.Minute * 10
@@ -971,10 +1009,9 @@ func wildcardMetadataBackend(qname, wildcard string) plugin.Handler {
 
 func TestEarlyRefreshCache(t *testing.T) {
 	c := newTestK8sCache(true)
-	ips := c.k8sAPI.getEarlyRefreshIPs()
-	if len(ips) == 0 {
-		t.Fatalf("No early refresh pods in k8sAPI.store")
-	} 
+	if c.k8sAPI.earlyRefreshPod("10.240.0.1") == nil {
+		t.Fatalf("No early refresh pods in k8sAPI pod stores")
+	}
 	c.Next = ttlBackend(60)
 
 	req := new(dns.Msg)
@@ -1029,8 +1066,9 @@ func TestEarlyRefreshCache(t *testing.T) {
 func TestNoEarlyRefreshCache(t *testing.T) {
 	c := newTestK8sCache(true)
 	// delete early refresh pods
-	for _, obj := range c.k8sAPI.store.List() {
-		c.k8sAPI.store.Delete(obj)
+	store := c.k8sAPI.podWatchers[metav1.NamespaceAll].store
+	for _, obj := range store.List() {
+		store.Delete(obj)
 	}
 	c.Next = ttlBackend(60)
 
@@ -1070,3 +1108,207 @@ func TestNoEarlyRefreshCache(t *testing.T) {
 		}
 	}
 }
+
+func TestEarlyRefreshLead(t *testing.T) {
+	c := newTestK8sCache(true)
+	c.extrattl = 10 * time.Second
+	store := c.k8sAPI.podWatchers[metav1.NamespaceAll].store
+	pod := earlyRefreshPod("default", "test", "10.240.0.1")
+	pod.Annotations = map[string]string{earlyRefreshLeadAnnotation: "4s"}
+	store.Update(pod)
+	c.Next = ttlBackend(60)
+
+	req := new(dns.Msg)
+	req.SetQuestion("cached.org.", dns.TypeA)
+	ctx := context.TODO()
+
+	// Cache cached.org. with 60s TTL, the pod gets it 6s earlier than normal clients
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	c.ServeDNS(ctx, rec, req)
+	if c.pcache.Len() != 1 {
+		t.Fatalf("Msg with > 0 TTL should have been cached")
+	}
+	if ttl := rec.Msg.Answer[0].Header().Ttl; ttl != 66 {
+		t.Errorf("Expected TTL 66 for pod with 4s lead, got %d", ttl)
+	}
+
+	// No more backend resolutions, just from cache if available.
+	c.Next = plugin.HandlerFunc(func(context.Context, dns.ResponseWriter, *dns.Msg) (int, error) {
+		return 255, nil // Below, a 255 means we tried querying upstream.
+	})
+
+	tests := []struct {
+		w              dns.ResponseWriter
+		futureSeconds  int
+		expectedResult int
+	}{
+		// pod with 4s lead
+		{&test.ResponseWriter{}, 59, 0},
+		{&test.ResponseWriter{}, 65, 0},
+		{&test.ResponseWriter{}, 67, 255},
+		// normal client
+		{&test.ResponseWriter6{}, 65, 0},
+		{&test.ResponseWriter6{}, 69, 0},
+		{&test.ResponseWriter6{}, 71, 255},
+	}
+
+	for i, tt := range tests {
+		rec := dnstest.NewRecorder(tt.w)
+		c.now = func() time.Time { return time.Now().Add(time.Duration(tt.futureSeconds) * time.Second) }
+		if ret, _ := c.ServeDNS(ctx, rec, req.Copy()); ret != tt.expectedResult {
+			t.Errorf("Test %d: expecting %v; got %v", i, tt.expectedResult, ret)
+		}
+	}
+}
+
+func TestEarlyRefreshLeadAnnotation(t *testing.T) {
+	c := newTestK8sCache(true)
+	c.extrattl = 10 * time.Second
+	store := c.k8sAPI.podWatchers[metav1.NamespaceAll].store
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	state := request.Request{W: &test.ResponseWriter{}, Req: req}
+
+	tests := []struct {
+		annotation   string
+		expectedLead time.Duration
+	}{
+		{"", 10 * time.Second},
+		{"4s", 4 * time.Second},
+		{"2500ms", 2 * time.Second},
+		{"0s", 0},
+		{"30s", 10 * time.Second},
+		{"-5s", 10 * time.Second},
+		{"soon", 10 * time.Second},
+	}
+	for i, tt := range tests {
+		pod := earlyRefreshPod("default", "test", "10.240.0.1")
+		if tt.annotation != "" {
+			pod.Annotations = map[string]string{earlyRefreshLeadAnnotation: tt.annotation}
+		}
+		store.Update(pod)
+		lead, early := c.earlyRefreshLead(state)
+		if !early {
+			t.Errorf("Test %d: expected early refresh client", i)
+		}
+		if lead != tt.expectedLead {
+			t.Errorf("Test %d: expected lead %v, got %v", i, tt.expectedLead, lead)
+		}
+	}
+}
+
+func TestEarlyRefreshZones(t *testing.T) {
+	c := newTestK8sCache(true)
+	c.extrattl = 5 * time.Second
+	c.zonettls = map[string]time.Duration{
+		"corp.example.":    30 * time.Second,
+		"eu.corp.example.": 10 * time.Second,
+	}
+	c.ttlzones = []string{"corp.example.", "eu.corp.example."}
+
+	tests := []struct {
+		qname            string
+		expectedExtraTTL time.Duration
+	}{
+		{"saas.example.org.", 5 * time.Second},
+		{"corp.example.", 30 * time.Second},
+		{"www.corp.example.", 30 * time.Second},
+		{"www.eu.corp.example.", 10 * time.Second},
+	}
+	for i, tt := range tests {
+		if got := c.extraTTL(tt.qname); got != tt.expectedExtraTTL {
+			t.Errorf("Test %d: expected earlyrefresh %v for %s, got %v", i, tt.expectedExtraTTL, tt.qname, got)
+		}
+	}
+
+	// Normal clients see the answer 30s later in corp.example. and 5s later elsewhere
+	ctx := context.TODO()
+	for _, qname := range []string{"www.corp.example.", "saas.example.org."} {
+		c.Next = ttlBackend(60)
+		req := new(dns.Msg)
+		req.SetQuestion(qname, dns.TypeA)
+		rec := dnstest.NewRecorder(&test.ResponseWriter6{})
+		c.ServeDNS(ctx, rec, req)
+		if want, got := 60+uint32(c.extraTTL(qname).Seconds()), rec.Msg.Answer[0].Header().Ttl; want != got {
+			t.Errorf("Expected TTL %d for normal client querying %s, got %d", want, qname, got)
+		}
+	}
+
+	c.Next = plugin.HandlerFunc(func(context.Context, dns.ResponseWriter, *dns.Msg) (int, error) {
+		return 255, nil // Below, a 255 means we tried querying upstream.
+	})
+	tests2 := []struct {
+		qname          string
+		futureSeconds  int
+		expectedResult int
+	}{
+		{"saas.example.org.", 64, 0},
+		{"saas.example.org.", 66, 255},
+		{"www.corp.example.", 66, 0},
+		{"www.corp.example.", 89, 0},
+		{"www.corp.example.", 91, 255},
+	}
+	for i, tt := range tests2 {
+		rec := dnstest.NewRecorder(&test.ResponseWriter6{})
+		c.now = func() time.Time { return time.Now().Add(time.Duration(tt.futureSeconds) * time.Second) }
+		req := new(dns.Msg)
+		req.SetQuestion(tt.qname, dns.TypeA)
+		if ret, _ := c.ServeDNS(ctx, rec, req); ret != tt.expectedResult {
+			t.Errorf("Test %d: expecting %v; got %v", i, tt.expectedResult, ret)
+		}
+	}
+}
+
+func TestLateDenial(t *testing.T) {
+	tests := []struct {
+		latedenial bool
+		first      plugin.Handler
+		second     plugin.Handler
+		// expected rcodes for a normal client 2s and 6s after the early refresh pod got the new answer
+		expectedBefore int
+		expectedAfter  int
+	}{
+		{true, nxDomainBackend(60), ttlBackend(60), dns.RcodeNameError, dns.RcodeSuccess},
+		{true, ttlBackend(60), nxDomainBackend(60), dns.RcodeSuccess, dns.RcodeNameError},
+		{false, nxDomainBackend(60), ttlBackend(60), dns.RcodeSuccess, dns.RcodeSuccess},
+	}
+	for i, tt := range tests {
+		c := newTestK8sCache(true)
+		if tt.latedenial {
+			c.latedenial = true
+			c.latencache = cache.New(defaultCap)
+		}
+		ctx := context.TODO()
+		req := new(dns.Msg)
+		req.SetQuestion("flip.example.org.", dns.TypeA)
+		t0 := time.Now()
+
+		// Both the early refresh pod and a normal client get the first answer
+		c.Next = tt.first
+		c.now = func() time.Time { return t0 }
+		c.ServeDNS(ctx, dnstest.NewRecorder(&test.ResponseWriter{}), req.Copy())
+		c.ServeDNS(ctx, dnstest.NewRecorder(&test.ResponseWriter6{}), req.Copy())
+
+		// The early refresh pod gets the new answer after the first one expired
+		c.Next = tt.second
+		c.now = func() time.Time { return t0.Add(61 * time.Second) }
+		c.ServeDNS(ctx, dnstest.NewRecorder(&test.ResponseWriter{}), req.Copy())
+
+		c.Next = plugin.HandlerFunc(func(context.Context, dns.ResponseWriter, *dns.Msg) (int, error) {
+			return 255, nil // Below, a 255 means we tried querying upstream.
+		})
+		for _, after := range []struct {
+			seconds  int
+			expected int
+		}{{63, tt.expectedBefore}, {67, tt.expectedAfter}} {
+			c.now = func() time.Time { return t0.Add(time.Duration(after.seconds) * time.Second) }
+			rec := dnstest.NewRecorder(&test.ResponseWriter6{})
+			if ret, _ := c.ServeDNS(ctx, rec, req.Copy()); ret == 255 {
+				t.Errorf("Test %d: after %ds: expected answer from cache, got upstream query", i, after.seconds)
+			} else if rec.Rcode != after.expected {
+				t.Errorf("Test %d: after %ds: expected rcode %d, got %d", i, after.seconds, after.expected, rec.Rcode)
+			}
+		}
+	}
+}
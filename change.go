@@ -0,0 +1,123 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/cache"
+
+	"github.com/miekg/dns"
+)
+
+const changeWebhookTimeout = 5 * time.Second
+
+// changeEvent describes a new answer in the early cache that differs from the answer that normal
+// clients still get from the late cache, until Visible.
+type changeEvent struct {
+	Name     string    `json:"name"`
+	QType    string    `json:"qtype"`
+	OldRcode string    `json:"oldRcode"`
+	NewRcode string    `json:"newRcode"`
+	Old      []string  `json:"old"`
+	New      []string  `json:"new"`
+	Visible  time.Time `json:"visible"`
+}
+
+// detectChange compares item i, just added to the early cache with key, with the unexpired item
+// for key in the late caches of normal clients, and reports a change if they differ. The change is
+// not reported again if prev, the item i replaced in the early cache, already had the same answer.
+// It returns the late item if a change is reported.
+func (c *Cache) detectChange(key uint64, prev, i *item, now time.Time, server string) *item {
+	if prev != nil && sameAnswer(prev, i) {
+		return nil
+	}
+	var li *item
+	for _, lc := range []*cache.Cache{c.latepcache, c.latencache} {
+		if lc == nil {
+			continue
+		}
+		if ii, ok := lc.Get(key); ok && ii.(*item).ttl(now) > 0 {
+			li = ii.(*item)
+		}
+	}
+	if li == nil || sameAnswer(li, i) {
+		return nil
+	}
+	e := changeEvent{
+		Name:     i.Name,
+		QType:    dns.TypeToString[i.QType],
+		OldRcode: dns.RcodeToString[li.Rcode],
+		NewRcode: dns.RcodeToString[i.Rcode],
+		Old:      rrData(li.Answer),
+		New:      rrData(i.Answer),
+		Visible:  li.stored.Add(time.Duration(li.origTTL) * time.Second),
+	}
+	answerChanges.WithLabelValues(server, c.zonesMetricLabel, c.viewMetricLabel).Inc()
+	log.Infof("Answer for %s %s changed from %s %v to %s %v, visible to normal clients at %s",
+		e.Name, e.QType, e.OldRcode, e.Old, e.NewRcode, e.New, e.Visible.Format(time.RFC3339))
+	if c.changeWebhook != "" {
+		go c.notifyChange(e)
+	}
+	return li
+}
+
+// notifyChange posts e to c.changeWebhook.
+func (c *Cache) notifyChange(e changeEvent) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		log.Errorf("Failed to encode answer change: %s", err)
+		return
+	}
+	client := &http.Client{Timeout: changeWebhookTimeout}
+	resp, err := client.Post(c.changeWebhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Warningf("Failed to notify answer change of %s: %s", e.Name, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Warningf("Failed to notify answer change of %s: %s", e.Name, resp.Status)
+	}
+}
+
+// earlyItem returns the item for key in the early caches, if any.
+func (c *Cache) earlyItem(key uint64) *item {
+	if i, ok := c.pcache.Get(key); ok {
+		return i.(*item)
+	}
+	if i, ok := c.ncache.Get(key); ok {
+		return i.(*item)
+	}
+	return nil
+}
+
+// sameAnswer returns true if a and b have the same rcode and answer records, ignoring TTLs.
+func sameAnswer(a, b *item) bool {
+	return a.Rcode == b.Rcode && equalStrings(rrData(a.Answer), rrData(b.Answer))
+}
+
+// rrData returns the sorted data of rrs, without owner names and TTLs.
+func rrData(rrs []dns.RR) []string {
+	data := make([]string, 0, len(rrs))
+	for _, rr := range rrs {
+		data = append(data, strings.TrimPrefix(rr.String(), rr.Header().String()))
+	}
+	sort.Strings(data)
+	return data
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
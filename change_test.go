@@ -0,0 +1,94 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func addressBackend(ip string, ttl int) plugin.Handler {
+	return plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Response, m.RecursionAvailable = true, true
+
+		m.Answer = []dns.RR{test.A(fmt.Sprintf("example.org. %d IN A %s", ttl, ip))}
+		w.WriteMsg(m)
+		return dns.RcodeSuccess, nil
+	})
+}
+
+func TestChangeDetection(t *testing.T) {
+	events := make(chan changeEvent, 10)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e changeEvent
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			t.Errorf("Failed to decode change event: %s", err)
+		}
+		events <- e
+	}))
+	defer s.Close()
+
+	c := newTestK8sCache(true)
+	c.minpttl = 0
+	c.changeWebhook = s.URL
+	ctx := context.TODO()
+	start := time.Now()
+	changes := func() float64 {
+		return testutil.ToFloat64(answerChanges.WithLabelValues("", c.zonesMetricLabel, c.viewMetricLabel))
+	}
+	before := changes()
+
+	tests := []struct {
+		futureSeconds int
+		w             dns.ResponseWriter
+		ip            string
+		ttl           int
+	}{
+		{0, &test.ResponseWriter6{}, "127.0.0.1", 10}, // Late cache valid until 15s
+		{11, &test.ResponseWriter{}, "127.0.0.1", 1},  // Refreshed, same answer
+		{12, &test.ResponseWriter{}, "127.0.0.2", 1},  // Changed
+		{13, &test.ResponseWriter{}, "127.0.0.2", 1},  // Refreshed, change already reported
+	}
+	for _, tt := range tests {
+		c.now = func() time.Time { return start.Add(time.Duration(tt.futureSeconds) * time.Second) }
+		c.Next = addressBackend(tt.ip, tt.ttl)
+		req := new(dns.Msg)
+		req.SetQuestion("example.org.", dns.TypeA)
+		c.ServeDNS(ctx, dnstest.NewRecorder(tt.w), req)
+	}
+
+	if n := changes() - before; n != 1 {
+		t.Errorf("Expected 1 answer change, got %v", n)
+	}
+	select {
+	case e := <-events:
+		if e.Name != "example.org." || e.QType != "A" {
+			t.Errorf("Expected change of example.org. A, got %s %s", e.Name, e.QType)
+		}
+		if len(e.Old) != 1 || e.Old[0] != "127.0.0.1" || len(e.New) != 1 || e.New[0] != "127.0.0.2" {
+			t.Errorf("Expected change from 127.0.0.1 to 127.0.0.2, got %v to %v", e.Old, e.New)
+		}
+		if !e.Visible.Equal(start.Add(15 * time.Second)) {
+			t.Errorf("Expected change to be visible at %s, got %s", start.Add(15*time.Second), e.Visible)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for change webhook")
+	}
+	select {
+	case e := <-events:
+		t.Errorf("Expected a single change event, got another: %+v", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
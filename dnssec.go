@@ -12,12 +12,12 @@ func filterRRSlice(rrs []dns.RR, ttl uint32, dup bool) []dns.RR {
 		if r.Header().Rrtype == dns.TypeOPT {
 			continue
 		}
-		r.Header().Ttl = ttl
 		if dup {
 			rs[j] = dns.Copy(r)
 		} else {
 			rs[j] = r
 		}
+		rs[j].Header().Ttl = ttl
 		j++
 	}
 	return rs[:j]
@@ -0,0 +1,43 @@
+package cache
+
+import (
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// addEDE adds the extended DNS error ede (RFC 8914) to the reply m, if the client of state
+// supports EDNS0. The OPT record of the reply uses the buffer size of the client.
+func addEDE(state request.Request, m *dns.Msg, ede *dns.EDNS0_EDE) {
+	if !state.SizeAndDo(m) {
+		return
+	}
+	o := m.IsEdns0()
+	o.Option = append(o.Option, ede)
+}
+
+// extendedError returns the extended DNS error for a reply from item i, if extended errors are
+// enabled for its cache type. Stale items are marked as such, and cached SERVFAIL responses as
+// cached errors.
+func (c *Cache) extendedError(i *item, stale bool) *dns.EDNS0_EDE {
+	switch {
+	case i.Rcode == dns.RcodeServerFailure:
+		if c.edeDenial {
+			return &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeCachedError}
+		}
+	case !stale:
+	case i.Rcode == dns.RcodeNameError:
+		if c.edeDenial {
+			return &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeStaleNXDOMAINAnswer}
+		}
+	case i.denial():
+		if c.edeDenial {
+			return &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeStaleAnswer}
+		}
+	default:
+		if c.edeSuccess {
+			return &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeStaleAnswer}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+func TestExtendedErrors(t *testing.T) {
+	tests := []struct {
+		next          plugin.Handler
+		futureSeconds int
+		edeSuccess    bool
+		edeDenial     bool
+		code          int // Expected extended error code, or -1 for none
+	}{
+		{ttlBackend(60), 120, true, true, int(dns.ExtendedErrorCodeStaleAnswer)},
+		{ttlBackend(60), 120, false, true, -1},
+		{ttlBackend(60), 30, true, true, -1}, // Not stale
+		{nxDomainBackend(60), 120, true, true, int(dns.ExtendedErrorCodeStaleNXDOMAINAnswer)},
+		{nxDomainBackend(60), 120, true, false, -1},
+		{servFailBackend(0), 1, true, true, int(dns.ExtendedErrorCodeCachedError)},
+		{servFailBackend(0), 1, true, false, -1},
+	}
+	ctx := context.TODO()
+	for i, tt := range tests {
+		c := newTestK8sCache(false)
+		c.staleUpTo = time.Hour
+		c.edeSuccess = tt.edeSuccess
+		c.edeDenial = tt.edeDenial
+		c.Next = tt.next
+		req := new(dns.Msg)
+		req.SetQuestion("example.org.", dns.TypeA)
+		req.SetEdns0(1232, false)
+		c.ServeDNS(ctx, dnstest.NewRecorder(&test.ResponseWriter{}), req.Copy())
+
+		c.now = func() time.Time { return time.Now().Add(time.Duration(tt.futureSeconds) * time.Second) }
+		c.Next = plugin.HandlerFunc(func(context.Context, dns.ResponseWriter, *dns.Msg) (int, error) {
+			return 255, nil // Below, a 255 means we tried querying upstream.
+		})
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		c.ServeDNS(ctx, rec, req.Copy())
+		ede := extendedError(rec.Msg)
+		if tt.code < 0 {
+			if ede != nil {
+				t.Errorf("Test %d: expected no extended error, got %v", i, ede)
+			}
+			continue
+		}
+		if ede == nil || int(ede.InfoCode) != tt.code {
+			t.Errorf("Test %d: expected extended error %d, got %v", i, tt.code, ede)
+			continue
+		}
+		if size := rec.Msg.IsEdns0().UDPSize(); size != 1232 {
+			t.Errorf("Test %d: expected buffer size 1232 of the client, got %d", i, size)
+		}
+	}
+}
+
+func TestStaleDenialVerify(t *testing.T) {
+	tests := []struct {
+		next  plugin.Handler
+		rcode int
+		code  int // Expected extended error code, or -1 for none
+	}{
+		{ttlBackend(60), dns.RcodeSuccess, -1}, // Verified, the new answer replaces the stale denial
+		{servFailBackend(0), dns.RcodeNameError, int(dns.ExtendedErrorCodeStaleNXDOMAINAnswer)},
+	}
+	ctx := context.TODO()
+	for i, tt := range tests {
+		c := newTestK8sCache(false)
+		c.staleUpTo = time.Hour
+		c.verifyStale = true
+		c.edeDenial = true
+		c.Next = nxDomainBackend(60)
+		req := new(dns.Msg)
+		req.SetQuestion("example.org.", dns.TypeA)
+		req.SetEdns0(1232, false)
+		c.ServeDNS(ctx, dnstest.NewRecorder(&test.ResponseWriter{}), req.Copy())
+
+		c.now = func() time.Time { return time.Now().Add(120 * time.Second) }
+		c.Next = tt.next
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		c.ServeDNS(ctx, rec, req.Copy())
+		if rec.Rcode != tt.rcode {
+			t.Errorf("Test %d: expected rcode %s, got %s", i, dns.RcodeToString[tt.rcode], dns.RcodeToString[rec.Rcode])
+			continue
+		}
+		ede := extendedError(rec.Msg)
+		if tt.code < 0 {
+			if ede != nil {
+				t.Errorf("Test %d: expected no extended error, got %v", i, ede)
+			}
+			continue
+		}
+		if ede == nil || int(ede.InfoCode) != tt.code {
+			t.Errorf("Test %d: expected extended error %d, got %v", i, tt.code, ede)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+func TestLateFallback(t *testing.T) {
+	tests := []struct {
+		lateFallback  time.Duration
+		futureSeconds int
+		rcode         int
+	}{
+		{0, 30, dns.RcodeServerFailure},
+		{time.Minute, 30, dns.RcodeSuccess},
+		{time.Minute, 74, dns.RcodeSuccess},
+		{time.Minute, 80, dns.RcodeServerFailure}, // The late item expired at 15s, too long ago
+	}
+	ctx := context.TODO()
+	for i, tt := range tests {
+		c := newTestK8sCache(true)
+		c.lateFallback = tt.lateFallback
+		c.Next = ttlBackend(10)
+		req := new(dns.Msg)
+		req.SetQuestion("example.org.", dns.TypeA)
+		req.SetEdns0(4096, false)
+		c.ServeDNS(ctx, dnstest.NewRecorder(&test.ResponseWriter6{}), req.Copy())
+
+		c.now = func() time.Time { return time.Now().Add(time.Duration(tt.futureSeconds) * time.Second) }
+		c.Next = servFailBackend(0)
+		rec := dnstest.NewRecorder(&test.ResponseWriter6{})
+		c.ServeDNS(ctx, rec, req.Copy())
+		if rec.Rcode != tt.rcode {
+			t.Errorf("Test %d: expected rcode %s, got %s", i, dns.RcodeToString[tt.rcode], dns.RcodeToString[rec.Rcode])
+			continue
+		}
+		if tt.rcode != dns.RcodeSuccess {
+			continue
+		}
+		if len(rec.Msg.Answer) != 1 || rec.Msg.Answer[0].Header().Ttl != 0 {
+			t.Errorf("Test %d: expected previous answer with TTL 0, got %v", i, rec.Msg.Answer)
+		}
+		if ede := extendedError(rec.Msg); ede == nil || ede.InfoCode != dns.ExtendedErrorCodeStaleAnswer {
+			t.Errorf("Test %d: expected Stale Answer extended error, got %v", i, ede)
+		}
+	}
+}
+
+func TestLateFallbackCachedServfail(t *testing.T) {
+	c := newTestK8sCache(true)
+	c.lateFallback = time.Minute
+	c.Next = ttlBackend(10)
+	ctx := context.TODO()
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	c.ServeDNS(ctx, dnstest.NewRecorder(&test.ResponseWriter6{}), req.Copy())
+
+	// An early refresh pod gets and caches the upstream failure
+	c.now = func() time.Time { return time.Now().Add(30 * time.Second) }
+	c.Next = servFailBackend(0)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	c.ServeDNS(ctx, rec, req.Copy())
+	if rec.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("Expected SERVFAIL for early refresh pod, got %s", dns.RcodeToString[rec.Rcode])
+	}
+
+	// Normal clients get the previous answer instead of the cached failure
+	c.Next = plugin.HandlerFunc(func(context.Context, dns.ResponseWriter, *dns.Msg) (int, error) {
+		return 255, nil // Below, a 255 means we tried querying upstream.
+	})
+	rec = dnstest.NewRecorder(&test.ResponseWriter6{})
+	if ret, _ := c.ServeDNS(ctx, rec, req.Copy()); ret == 255 {
+		t.Fatalf("Expected the cached failure to be used instead of querying upstream")
+	}
+	if rec.Rcode != dns.RcodeSuccess || len(rec.Msg.Answer) != 1 {
+		t.Errorf("Expected previous answer, got %s %v", dns.RcodeToString[rec.Rcode], rec.Msg.Answer)
+	}
+}
+
+// extendedError returns the extended DNS error in m, if any.
+func extendedError(m *dns.Msg) *dns.EDNS0_EDE {
+	o := m.IsEdns0()
+	if o == nil {
+		return nil
+	}
+	for _, opt := range o.Option {
+		if ede, ok := opt.(*dns.EDNS0_EDE); ok {
+			return ede
+		}
+	}
+	return nil
+}
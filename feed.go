@@ -0,0 +1,184 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/delta10/k8s_cache/feed"
+
+	"github.com/miekg/dns"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const feedQueueLen = 1000
+
+// feedServer streams the inserts into the early cache to subscribers over gRPC.
+type feedServer struct {
+	addr      string
+	tokenFile string // file with the token that acknowledgements must present, if any
+	token     []byte
+	cache     *Cache
+	server    *grpc.Server
+	done      chan struct{}
+
+	mu          sync.RWMutex
+	subscribers map[*feedSubscriber]struct{}
+}
+
+// feedSubscriber is a subscription for the names in zones, or all names if zones is empty.
+type feedSubscriber struct {
+	zones   []string
+	updates chan *feed.Update
+}
+
+func newFeedServer(c *Cache, addr string) *feedServer {
+	return &feedServer{
+		addr:        addr,
+		cache:       c,
+		subscribers: make(map[*feedSubscriber]struct{}),
+	}
+}
+
+// start starts the gRPC server on f.addr.
+func (f *feedServer) start() error {
+	if f.tokenFile != "" {
+		token, err := os.ReadFile(f.tokenFile)
+		if err != nil {
+			return err
+		}
+		f.token = bytes.TrimSpace(token)
+		if len(f.token) == 0 {
+			return errors.New("feed token file " + f.tokenFile + " is empty")
+		}
+	}
+	ln, err := net.Listen("tcp", f.addr)
+	if err != nil {
+		return err
+	}
+	s := feed.NewServer(f)
+	done := make(chan struct{})
+	f.server, f.done = s, done
+	go func() {
+		defer close(done)
+		if err := s.Serve(ln); err != nil && err != grpc.ErrServerStopped {
+			log.Errorf("Feed listener on %s failed: %s", f.addr, err)
+		}
+	}()
+	return nil
+}
+
+// stop stops the gRPC server and ends all subscriptions, if started.
+func (f *feedServer) stop() {
+	if f.server != nil {
+		f.server.Stop()
+		// The listener is only closed once Serve returns
+		<-f.done
+		f.server = nil
+	}
+}
+
+// Subscribe implements feed.Server. If the feed has a token, the request must present it.
+func (f *feedServer) Subscribe(req *feed.SubscribeRequest, stream feed.SubscribeServer) error {
+	if len(f.token) > 0 && !f.authorized(stream.Context()) {
+		return status.Error(codes.Unauthenticated, "invalid feed token")
+	}
+	s := &feedSubscriber{updates: make(chan *feed.Update, feedQueueLen)}
+	for _, z := range req.Zones {
+		s.zones = append(s.zones, plugin.Name(z).Normalize())
+	}
+	f.mu.Lock()
+	f.subscribers[s] = struct{}{}
+	f.mu.Unlock()
+	defer func() {
+		f.mu.Lock()
+		delete(f.subscribers, s)
+		f.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case u := <-s.updates:
+			if err := stream.Send(u); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Ack implements feed.Server. The request must present the token of the feed.
+func (f *feedServer) Ack(ctx context.Context, req *feed.AckRequest) (*feed.AckResponse, error) {
+	if !f.authorized(ctx) {
+		return nil, status.Error(codes.Unauthenticated, "invalid feed token")
+	}
+	qtype, ok := dns.StringToType[strings.ToUpper(req.QType)]
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown qtype %q", req.QType)
+	}
+	n := f.cache.ack(dns.Fqdn(req.Name), qtype, req.Records)
+	return &feed.AckResponse{Acknowledged: n}, nil
+}
+
+// authorized returns true if the request with ctx presents the token of the feed.
+func (f *feedServer) authorized(ctx context.Context) bool {
+	if len(f.token) == 0 {
+		return false
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, auth := range md.Get("authorization") {
+		if subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), f.token) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// publish queues u for the subscribers of its name. Subscribers that don't keep up miss updates.
+func (f *feedServer) publish(u *feed.Update) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for s := range f.subscribers {
+		if len(s.zones) > 0 && plugin.Zones(s.zones).Matches(u.Name) == "" {
+			continue
+		}
+		select {
+		case s.updates <- u:
+		default:
+			feedDrops.Inc()
+		}
+	}
+}
+
+// publish sends item i, just inserted into the early cache, to the feed subscribers, if the feed
+// is enabled.
+func (c *Cache) publish(i *item) {
+	if c.feed == nil {
+		return
+	}
+	expiry := i.stored.Add(time.Duration(i.origTTL) * time.Second)
+	u := &feed.Update{
+		Name:       i.Name,
+		QType:      dns.TypeToString[i.QType],
+		Rcode:      dns.RcodeToString[i.Rcode],
+		Records:    rrData(i.Answer),
+		TTL:        i.origTTL,
+		Stored:     i.stored,
+		LateExpiry: expiry,
+	}
+	if c.isLate(i) {
+		u.LateExpiry = expiry.Add(c.extraTTL(i.Name))
+	}
+	c.feed.publish(u)
+}
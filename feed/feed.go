@@ -0,0 +1,208 @@
+// Package feed implements the gRPC feed of the k8s_cache plugin, which streams every insert into
+// the early cache to subscribers such as FQDN network policy controllers. Messages are encoded as
+// JSON, so no generated code is needed on either side.
+package feed
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// ServiceName is the name of the gRPC service.
+const ServiceName = "k8s_cache.Feed"
+
+// SubscribeRequest starts a subscription. If Zones is not empty, only names in these zones are
+// sent.
+type SubscribeRequest struct {
+	Zones []string `json:"zones,omitempty"`
+}
+
+// Update is a new item in the early cache.
+type Update struct {
+	Name       string    `json:"name"`
+	QType      string    `json:"qtype"`
+	Rcode      string    `json:"rcode"`
+	Records    []string  `json:"records,omitempty"` // Data of the answer records
+	TTL        uint32    `json:"ttl"`               // TTL in the early cache
+	Stored     time.Time `json:"stored"`
+	LateExpiry time.Time `json:"lateExpiry"` // Expiry in the late cache for normal clients
+}
+
+// AckRequest acknowledges the current answer for Name and QType, so that normal clients can get
+// it. If Records is not empty, the answer is only acknowledged if its records are Records.
+type AckRequest struct {
+	Name    string   `json:"name"`
+	QType   string   `json:"qtype"`
+	Records []string `json:"records,omitempty"`
+}
+
+// AckResponse returns the number of acknowledged cache items.
+type AckResponse struct {
+	Acknowledged int `json:"acknowledged"`
+}
+
+// Codec is the JSON codec used by the feed.
+type Codec struct{}
+
+// Marshal implements encoding.Codec.
+func (Codec) Marshal(v interface{}) ([]byte, error) { return json.Marshal(v) }
+
+// Unmarshal implements encoding.Codec.
+func (Codec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+// Name implements encoding.Codec.
+func (Codec) Name() string { return "json" }
+
+// Server is the server API of the feed.
+type Server interface {
+	Subscribe(*SubscribeRequest, SubscribeServer) error
+	Ack(context.Context, *AckRequest) (*AckResponse, error)
+}
+
+// SubscribeServer is the server side stream of a subscription.
+type SubscribeServer interface {
+	Send(*Update) error
+	grpc.ServerStream
+}
+
+// ServiceDesc is the gRPC service description of the feed.
+var ServiceDesc = grpc.ServiceDesc{
+	ServiceName: ServiceName,
+	HandlerType: (*Server)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Ack",
+			Handler:    ackHandler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Subscribe",
+			Handler:       subscribeHandler,
+			ServerStreams: true,
+		},
+	},
+}
+
+// NewServer returns a gRPC server for srv. The server must be created with this function, or with
+// the grpc.ForceServerCodec(Codec{}) option, to use the JSON codec.
+func NewServer(srv Server, opts ...grpc.ServerOption) *grpc.Server {
+	s := grpc.NewServer(append(opts, grpc.ForceServerCodec(Codec{}))...)
+	s.RegisterService(&ServiceDesc, srv)
+	return s
+}
+
+func subscribeHandler(srv interface{}, stream grpc.ServerStream) error {
+	req := new(SubscribeRequest)
+	if err := stream.RecvMsg(req); err != nil {
+		return err
+	}
+	return srv.(Server).Subscribe(req, &subscribeServer{stream})
+}
+
+func ackHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	req := new(AckRequest)
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(Server).Ack(ctx, req)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + ServiceName + "/Ack"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(Server).Ack(ctx, req.(*AckRequest))
+	}
+	return interceptor(ctx, req, info, handler)
+}
+
+type subscribeServer struct {
+	grpc.ServerStream
+}
+
+func (s *subscribeServer) Send(u *Update) error {
+	return s.ServerStream.SendMsg(u)
+}
+
+// Token returns credentials that present token to the feed, as required for acknowledgements, and
+// for subscriptions if the feed has a token. Use them with grpc.WithPerRPCCredentials.
+func Token(token string) credentials.PerRPCCredentials {
+	return tokenCredentials(token)
+}
+
+type tokenCredentials string
+
+func (t tokenCredentials) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(t)}, nil
+}
+
+// RequireTransportSecurity allows the token to be sent without TLS, as the feed is usually only
+// reachable within the cluster.
+func (t tokenCredentials) RequireTransportSecurity() bool { return false }
+
+// Client is a client of the feed.
+type Client struct {
+	conn *grpc.ClientConn
+}
+
+// NewClient returns a client for the feed at target. opts must at least configure the transport
+// credentials, e.g. with grpc.WithTransportCredentials(insecure.NewCredentials()).
+func NewClient(target string, opts ...grpc.DialOption) (*Client, error) {
+	conn, err := grpc.NewClient(target, append(opts, grpc.WithDefaultCallOptions(grpc.ForceCodec(Codec{})))...)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{conn: conn}, nil
+}
+
+// Close closes the connection of c.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Subscribe subscribes to the updates for names in zones, or for all names if no zones are
+// given. The subscription ends when ctx is done. If the feed has a token, the client must be created
+// with its Token.
+func (c *Client) Subscribe(ctx context.Context, zones ...string) (*Subscription, error) {
+	stream, err := c.conn.NewStream(ctx, &ServiceDesc.Streams[0], "/"+ServiceName+"/Subscribe")
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.SendMsg(&SubscribeRequest{Zones: zones}); err != nil {
+		return nil, err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return &Subscription{stream: stream}, nil
+}
+
+// Ack acknowledges the current answer for name and qtype, e.g. after allowing traffic to its
+// addresses. If records are given, the answer is only acknowledged if it still has these records.
+// It returns the number of acknowledged cache items. The client must be created with the Token of
+// the feed.
+func (c *Client) Ack(ctx context.Context, name, qtype string, records ...string) (int, error) {
+	resp := new(AckResponse)
+	err := c.conn.Invoke(ctx, "/"+ServiceName+"/Ack", &AckRequest{Name: name, QType: qtype, Records: records}, resp)
+	if err != nil {
+		return 0, err
+	}
+	return resp.Acknowledged, nil
+}
+
+// Subscription is a stream of updates.
+type Subscription struct {
+	stream grpc.ClientStream
+}
+
+// Recv returns the next update. It blocks until an update is available, or the subscription ends.
+func (s *Subscription) Recv() (*Update, error) {
+	u := new(Update)
+	if err := s.stream.RecvMsg(u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
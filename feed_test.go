@@ -0,0 +1,139 @@
+package cache
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/delta10/k8s_cache/feed"
+
+	"github.com/miekg/dns"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func (f *feedServer) subscriberCount() int {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return len(f.subscribers)
+}
+
+func TestFeed(t *testing.T) {
+	c := newTestK8sCache(true)
+	c.Next = ttlBackend(60)
+	c.feed = newFeedServer(c, "127.0.0.1:0")
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := feed.NewServer(c.feed)
+	go s.Serve(ln)
+	defer s.Stop()
+
+	client, err := feed.NewClient(ln.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	sub, err := client.Subscribe(ctx, "Example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "feed subscription", func() bool { return c.feed.subscriberCount() == 1 })
+
+	// Only the name in example.org is sent
+	for _, qname := range []string{"example.net.", "www.example.org."} {
+		req := new(dns.Msg)
+		req.SetQuestion(qname, dns.TypeA)
+		c.ServeDNS(context.TODO(), dnstest.NewRecorder(&test.ResponseWriter6{}), req)
+	}
+
+	u, err := sub.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Name != "www.example.org." || u.QType != "A" || u.Rcode != "NOERROR" {
+		t.Errorf("Expected update for www.example.org. A NOERROR, got %s %s %s", u.Name, u.QType, u.Rcode)
+	}
+	if len(u.Records) != 1 || u.Records[0] != "127.0.0.53" {
+		t.Errorf("Expected records [127.0.0.53], got %v", u.Records)
+	}
+	if u.TTL != 60 {
+		t.Errorf("Expected TTL 60, got %d", u.TTL)
+	}
+	if expected := u.Stored.Add(65 * time.Second); !u.LateExpiry.Equal(expected) {
+		t.Errorf("Expected late expiry %s, got %s", expected, u.LateExpiry)
+	}
+
+	cancel()
+	waitFor(t, "feed subscription to end", func() bool { return c.feed.subscriberCount() == 0 })
+}
+
+func TestFeedToken(t *testing.T) {
+	c := newTestK8sCache(true)
+	c.feed = newFeedServer(c, "127.0.0.1:0")
+	c.feed.token = []byte("secret")
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := feed.NewServer(c.feed)
+	go s.Serve(ln)
+	defer s.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, token := range []string{"", "wrong"} {
+		opts := []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+		if token != "" {
+			opts = append(opts, grpc.WithPerRPCCredentials(feed.Token(token)))
+		}
+		client, err := feed.NewClient(ln.Addr().String(), opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sub, err := client.Subscribe(ctx)
+		if err == nil {
+			_, err = sub.Recv()
+		}
+		if status.Code(err) != codes.Unauthenticated {
+			t.Errorf("Expected unauthenticated error for token %q, got %v", token, err)
+		}
+		client.Close()
+	}
+	if n := c.feed.subscriberCount(); n != 0 {
+		t.Errorf("Expected no subscribers, got %d", n)
+	}
+
+	client, err := feed.NewClient(ln.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithPerRPCCredentials(feed.Token("secret")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Subscribe(ctx); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "feed subscription", func() bool { return c.feed.subscriberCount() == 1 })
+}
+
+func TestFeedRestart(t *testing.T) {
+	f := newFeedServer(newTestK8sCache(false), freeAddr(t))
+	for n := 0; n < 2; n++ {
+		// A reload stops the listener, and starts it again if the new instance fails
+		if err := f.start(); err != nil {
+			t.Fatalf("Start %d: %s", n, err)
+		}
+		f.stop()
+	}
+	f.stop()
+}
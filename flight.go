@@ -0,0 +1,82 @@
+package cache
+
+import (
+	"context"
+
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// flight is an upstream query in progress for a cache key. Concurrent queries for the same key wait
+// for it, and are answered from its response.
+type flight struct {
+	done chan struct{}
+	msg  *dns.Msg // Response of upstream, if any; only set before done is closed.
+}
+
+// flightResponseWriter records the response of upstream for the queries waiting for a flight.
+type flightResponseWriter struct {
+	dns.ResponseWriter
+	flight *flight
+}
+
+// WriteMsg implements the dns.ResponseWriter interface.
+func (w *flightResponseWriter) WriteMsg(res *dns.Msg) error {
+	w.flight.msg = res.Copy()
+	return w.ResponseWriter.WriteMsg(res)
+}
+
+// joinFlight returns the flight for key, and whether the caller started it and must end it with
+// endFlight.
+func (c *Cache) joinFlight(key uint64) (*flight, bool) {
+	c.flightMu.Lock()
+	defer c.flightMu.Unlock()
+	if f, ok := c.flights[key]; ok {
+		return f, false
+	}
+	f := &flight{done: make(chan struct{})}
+	c.flights[key] = f
+	return f, true
+}
+
+// endFlight ends the flight f for key, and releases the queries waiting for it.
+func (c *Cache) endFlight(key uint64, f *flight) {
+	c.flightMu.Lock()
+	delete(c.flights, key)
+	c.flightMu.Unlock()
+	close(f.done)
+}
+
+// refresh queries upstream for state through crr, which caches the response. If a query for key is
+// already in progress, it waits for that query instead, and answers from its response.
+func (c *Cache) refresh(ctx context.Context, state request.Request, key uint64, crr *ResponseWriter) (int, error) {
+	return c.refreshThrough(ctx, state, key, crr, crr)
+}
+
+// refreshThrough is refresh for a writer cw that wraps crr, such as the writers that verify a stale
+// answer.
+func (c *Cache) refreshThrough(ctx context.Context, state request.Request, key uint64, crr *ResponseWriter, cw dns.ResponseWriter) (int, error) {
+	f, leader := c.joinFlight(key)
+	if leader {
+		defer c.endFlight(key, f)
+		return c.doRefresh(ctx, state, &flightResponseWriter{ResponseWriter: cw, flight: f})
+	}
+
+	coalescedRequests.WithLabelValues(crr.server, c.zonesMetricLabel, c.viewMetricLabel).Inc()
+	select {
+	case <-f.done:
+	case <-ctx.Done():
+		return dns.RcodeServerFailure, ctx.Err()
+	}
+	if f.msg == nil {
+		// The query in progress got no response, try upstream ourselves
+		return c.doRefresh(ctx, state, cw)
+	}
+	m := f.msg.Copy()
+	m.Id = state.Req.Id
+	m.Question = state.Req.Question
+	crr.shared = true
+	cw.WriteMsg(m)
+	return m.Rcode, nil
+}
@@ -0,0 +1,128 @@
+package cache
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCoalescedRefresh(t *testing.T) {
+	tests := []struct {
+		next   plugin.Handler
+		rcode  int
+		answer bool
+	}{
+		{ttlBackend(60), dns.RcodeSuccess, true},
+		{servFailBackend(0), dns.RcodeServerFailure, false},
+	}
+	ctx := context.TODO()
+	for i, tt := range tests {
+		c := newTestK8sCache(true)
+		var queries int32
+		release := make(chan struct{})
+		c.Next = plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+			atomic.AddInt32(&queries, 1)
+			<-release
+			return tt.next.ServeDNS(ctx, w, r)
+		})
+		coalesced := testutil.ToFloat64(coalescedRequests.WithLabelValues("", c.zonesMetricLabel, c.viewMetricLabel))
+
+		// Early refresh pods and normal clients query the same name concurrently
+		writers := []dns.ResponseWriter{&test.ResponseWriter{}, &test.ResponseWriter6{}, &test.ResponseWriter{}, &test.ResponseWriter6{}}
+		recs := make([]*dnstest.Recorder, len(writers))
+		var wg sync.WaitGroup
+		for j, w := range writers {
+			recs[j] = dnstest.NewRecorder(w)
+			wg.Add(1)
+			go func(rec *dnstest.Recorder) {
+				defer wg.Done()
+				req := new(dns.Msg)
+				req.SetQuestion("example.org.", dns.TypeA)
+				c.ServeDNS(ctx, rec, req)
+			}(recs[j])
+		}
+		waitFor(t, "coalesced requests", func() bool {
+			return testutil.ToFloat64(coalescedRequests.WithLabelValues("", c.zonesMetricLabel, c.viewMetricLabel))-coalesced == float64(len(writers)-1)
+		})
+		close(release)
+		wg.Wait()
+
+		if n := atomic.LoadInt32(&queries); n != 1 {
+			t.Errorf("Test %d: expected 1 upstream query, got %d", i, n)
+		}
+		for j, rec := range recs {
+			if rec.Msg == nil || rec.Rcode != tt.rcode || (len(rec.Msg.Answer) == 1) != tt.answer {
+				t.Errorf("Test %d: client %d: expected rcode %s, got %v", i, j, dns.RcodeToString[tt.rcode], rec.Msg)
+			}
+		}
+	}
+}
+
+func TestCoalescedVerifyStale(t *testing.T) {
+	tests := []struct {
+		staleTimeout time.Duration
+		next         plugin.Handler
+		ttl          uint32
+	}{
+		{0, ttlBackend(60), 60},
+		{0, servFailBackend(0), 0}, // Stale answer
+		{time.Hour, ttlBackend(60), 60},
+		{time.Hour, servFailBackend(0), 0},
+	}
+	ctx := context.TODO()
+	for i, tt := range tests {
+		c := newTestK8sCache(false)
+		c.staleUpTo = time.Hour
+		c.verifyStale = true
+		c.staleTimeout = tt.staleTimeout
+		c.Next = ttlBackend(60)
+		req := new(dns.Msg)
+		req.SetQuestion("example.org.", dns.TypeA)
+		c.ServeDNS(ctx, dnstest.NewRecorder(&test.ResponseWriter6{}), req.Copy())
+
+		c.now = func() time.Time { return time.Now().Add(120 * time.Second) }
+		var queries int32
+		release := make(chan struct{})
+		c.Next = plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+			atomic.AddInt32(&queries, 1)
+			<-release
+			return tt.next.ServeDNS(ctx, w, r)
+		})
+		coalesced := testutil.ToFloat64(coalescedRequests.WithLabelValues("", c.zonesMetricLabel, c.viewMetricLabel))
+
+		// Clients verifying the stale answer concurrently share one upstream query
+		recs := make([]*dnstest.Recorder, 3)
+		var wg sync.WaitGroup
+		for j := range recs {
+			recs[j] = dnstest.NewRecorder(&test.ResponseWriter6{})
+			wg.Add(1)
+			go func(rec *dnstest.Recorder) {
+				defer wg.Done()
+				c.ServeDNS(ctx, rec, req.Copy())
+			}(recs[j])
+		}
+		waitFor(t, "coalesced requests", func() bool {
+			return testutil.ToFloat64(coalescedRequests.WithLabelValues("", c.zonesMetricLabel, c.viewMetricLabel))-coalesced == float64(len(recs)-1)
+		})
+		close(release)
+		wg.Wait()
+
+		if n := atomic.LoadInt32(&queries); n != 1 {
+			t.Errorf("Test %d: expected 1 upstream query, got %d", i, n)
+		}
+		for j, rec := range recs {
+			if rec.Msg == nil || rec.Rcode != dns.RcodeSuccess || len(rec.Msg.Answer) != 1 || rec.Msg.Answer[0].Header().Ttl != tt.ttl {
+				t.Errorf("Test %d: client %d: expected answer with TTL %d, got %v", i, j, tt.ttl, rec.Msg)
+			}
+		}
+	}
+}
@@ -46,6 +46,13 @@ func (f *Freq) Hits() int {
 	return f.hits
 }
 
+// Last returns the last time we've seen this entity.
+func (f *Freq) Last() time.Time {
+	f.RLock()
+	defer f.RUnlock()
+	return f.last
+}
+
 // Reset resets f to time t and hits to hits.
 func (f *Freq) Reset(t time.Time, hits int) {
 	f.Lock()
@@ -29,6 +29,15 @@ func TestReset(t *testing.T) {
 	hitsCheck(t, f, 0)
 }
 
+func TestLast(t *testing.T) {
+	now := time.Now().UTC()
+	f := New(now.Add(-1 * time.Minute))
+	f.Update(1*time.Minute, now)
+	if last := f.Last(); !last.Equal(now) {
+		t.Fatalf("Expected last to be %s, got %s", now, last)
+	}
+}
+
 func hitsCheck(t *testing.T, f *Freq, expected int) {
 	if x := f.Hits(); x != expected {
 		t.Fatalf("Expected hits to be %d, got %d", expected, x)
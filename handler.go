@@ -29,50 +29,115 @@ func (c *Cache) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg)
 	now := c.now().UTC()
 	server := metrics.WithServer(ctx)
 
+	if c.isPurge(state) {
+		return c.servePurge(w, r, state, server)
+	}
+
 	// On cache refresh, we will just use the DO bit from the incoming query for the refresh since we key our cache
 	// with the query DO bit. That means two separate cache items for the query DO bit true or false. In the situation
 	// in which upstream doesn't support DNSSEC, the two cache items will effectively be the same. Regardless, any
 	// DNSSEC RRs in the response are written to cache with the response.
 
 	var i *item
+	var ede *dns.EDNS0_EDE // Extended DNS error to add to the reply, if any
 	key := hash(state.Name(), state.QType(), state.Do(), state.Req.CheckingDisabled)
-	if c.NeedEarlyRefresh(state) {
+	extrattl := c.extraTTL(state.Name())
+	lead, early := c.earlyRefreshLead(state)
+	client := "normal"
+	if early {
+		client = "early"
+	}
+	clientRequests.WithLabelValues(server, client, c.zonesMetricLabel, c.viewMetricLabel).Inc()
+	scoped := c.earlyRefreshScope(state.Name())
+	if early && lead >= extrattl && scoped {
 		i = c.getEarly(now, state, server)
 		if i == nil {
 			crr := &ResponseWriter{
 				ResponseWriter: w, Cache: c, state: state, server: server, do: do, ad: ad, cd: cd,
 				nexcept: c.nexcept, pexcept: c.pexcept, wildcardFunc: wildcardFunc(ctx),
 			}
-			return c.doRefresh(ctx, state, crr)
+			return c.refresh(ctx, state, key, crr)
 		} else if c.shouldPrefetch(i, now) {
 			cw := newPrefetchResponseWriter(server, state, c)
-			go c.doPrefetch(ctx, state, cw, i, now)
+			c.schedulePrefetch(ctx, state, cw, i, now, early)
 		}
 	} else {
-		i = c.getLate(now, state, server)
+		// Normal clients, and early refresh pods that declared a shorter lead, use a late cache
+		delay := extrattl - lead
+		fallback := false
+		if scoped {
+			i = c.getLateLead(now, state, server, lead)
+		} else {
+			// Names out of scope of early refreshes are served from the early cache, as by the
+			// cache plugin
+			i = c.getIgnoreTTL(now, state, server)
+		}
 		if i == nil {
-			i = c.getEarly(now, state, server)
-			if i == nil {
+			if scoped {
+				// getIgnoreTTL already looked in the early cache
+				i = c.getEarly(now, state, server)
+			}
+			li := c.getLateFallback(now, state, lead)
+			if li != nil && (i == nil || i.Rcode == dns.RcodeServerFailure) {
+				// Serve the previous late answer instead of an upstream failure
+				if i == nil {
+					crr := &ResponseWriter{
+						ResponseWriter: w, Cache: c, state: state, server: server, do: do, ad: ad, cd: cd,
+						nexcept: c.nexcept, pexcept: c.pexcept, wildcardFunc: wildcardFunc(ctx),
+					}
+					cw := newVerifyStaleResponseWriter(crr)
+					ret, err := c.refreshThrough(ctx, state, key, crr, cw)
+					if cw.refreshed {
+						return ret, err
+					}
+				}
+				i = li
+				fallback = true
+				ede = &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeStaleAnswer}
+				// Adjust the time to get a 0 TTL in the reply built from an expired item.
+				now = now.Add(time.Duration(i.ttl(now)) * time.Second)
+				lateFallbacks.WithLabelValues(server, c.zonesMetricLabel, c.viewMetricLabel).Inc()
+			} else if i == nil {
 				crr := &ResponseWriter{
 					ResponseWriter: w, Cache: c, state: state, server: server, do: do, ad: ad, cd: cd,
 					nexcept: c.nexcept, pexcept: c.pexcept, wildcardFunc: wildcardFunc(ctx),
 				}
-				return c.doRefresh(ctx, state, crr)
+				return c.refresh(ctx, state, key, crr)
+			} else if prev := c.heldPrevious(key, lead, now); prev != nil {
+				// The late cache lost the previous answer, keep serving it while the new one is held
+				i = prev
 			} else {
-				c.copyToLate(key, i, now)
-				if c.shouldPrefetch(i, now) {
-					cw := newPrefetchResponseWriter(server, state, c)
-					go c.doPrefetch(ctx, state, cw, i, now)
-				}
+				c.copyToLate(key, i, now, server)
+				// The TTL of an item from the early cache doesn't include the delay
+				delay = 0
 			}
-		} else {
+		}
+		if !fallback {
 			ttl := i.ttl(now)
 			if ttl < 0 {
 				// serve stale behavior
-				if c.verifyStale {
+				if c.verifyStale && c.staleTimeout > 0 {
+					// Wait for the refresh until the client response timer fires, and let it
+					// update the cache in the background after that.
+					crr := &ResponseWriter{ResponseWriter: w, Cache: c, state: state, server: server, do: do, cd: cd, remoteAddr: w.RemoteAddr()}
+					cw := newStaleTimerResponseWriter(crr)
+					go func() {
+						c.refreshThrough(ctx, state, key, crr, cw)
+						close(cw.done)
+					}()
+					timer := time.NewTimer(c.staleTimeout)
+					select {
+					case <-cw.done:
+					case <-timer.C:
+					}
+					timer.Stop()
+					if !cw.timeout() {
+						return dns.RcodeSuccess, nil
+					}
+				} else if c.verifyStale {
 					crr := &ResponseWriter{ResponseWriter: w, Cache: c, state: state, server: server, do: do, cd: cd}
 					cw := newVerifyStaleResponseWriter(crr)
-					ret, err := c.doRefresh(ctx, state, cw)
+					ret, err := c.refreshThrough(ctx, state, key, crr, cw)
 					if cw.refreshed {
 						return ret, err
 					}
@@ -82,12 +147,13 @@ func (c *Cache) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg)
 				now = now.Add(time.Duration(ttl) * time.Second)
 				if !c.verifyStale {
 					cw := newPrefetchResponseWriter(server, state, c)
-					go c.doPrefetch(ctx, state, cw, i, now)
+					c.schedulePrefetch(ctx, state, cw, i, now, early)
 				}
 				servedStale.WithLabelValues(server, c.zonesMetricLabel, c.viewMetricLabel).Inc()
-			} else if c.shouldPrefetch(i, now.Add(-c.extrattl)) {
+				ede = c.extendedError(i, true)
+			} else if c.shouldPrefetch(i, now.Add(-delay)) {
 				cw := newPrefetchResponseWriter(server, state, c)
-				go c.doPrefetch(ctx, state, cw, i, now)
+				c.schedulePrefetch(ctx, state, cw, i, now, early)
 			}
 		}
 	}
@@ -105,6 +171,12 @@ func (c *Cache) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg)
 		now = i.stored
 	}
 	resp := i.toMsg(r, now, do, ad)
+	if ede == nil {
+		ede = c.extendedError(i, false)
+	}
+	if ede != nil {
+		addEDE(state, resp, ede)
+	}
 	w.WriteMsg(resp)
 	return dns.RcodeSuccess, nil
 }
@@ -120,13 +192,22 @@ func wildcardFunc(ctx context.Context) func() string {
 }
 
 func (c *Cache) doPrefetch(ctx context.Context, state request.Request, cw *ResponseWriter, i *item, now time.Time) {
+	// Don't prefetch if the name is already being refreshed
+	key := hash(state.Name(), state.QType(), state.Do(), state.Req.CheckingDisabled)
+	f, leader := c.joinFlight(key)
+	if !leader {
+		coalescedRequests.WithLabelValues(cw.server, c.zonesMetricLabel, c.viewMetricLabel).Inc()
+		return
+	}
+	defer c.endFlight(key, f)
+
 	cachePrefetches.WithLabelValues(cw.server, c.zonesMetricLabel, c.viewMetricLabel).Inc()
-	c.doRefresh(ctx, state, cw)
+	c.doRefresh(ctx, state, &flightResponseWriter{ResponseWriter: cw, flight: f})
 
 	// When prefetching we loose the item i, and with it the frequency
 	// that we've gathered sofar. See we copy the frequencies info back
 	// into the new item that was stored in the cache.
-	if i1 := c.exists(state); i1 != nil {
+	if i1 := c.exists(state); i1 != nil && i != nil {
 		i1.Freq.Reset(now, i.Freq.Hits())
 	}
 }
@@ -136,10 +217,14 @@ func (c *Cache) doRefresh(ctx context.Context, state request.Request, cw dns.Res
 }
 
 func (c *Cache) shouldPrefetch(i *item, now time.Time) bool {
-	if c.prefetch <= 0 {
+	if c.prefetch <= 0 && c.hotRefresh == nil {
 		return false
 	}
 	i.Freq.Update(c.duration, now)
+	if c.prefetch <= 0 {
+		// Only count the hit for the hot refresh
+		return false
+	}
 	threshold := int(math.Ceil(float64(c.percentage) / 100 * float64(i.origTTL)))
 	return i.Freq.Hits() >= c.prefetch && i.ttl(now) <= threshold
 }
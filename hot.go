@@ -0,0 +1,115 @@
+package cache
+
+import (
+	"context"
+	"math"
+	"net"
+	"time"
+
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+const defaultHotRefreshInterval = 5 * time.Second
+
+// hotRefresher periodically refreshes popular names in the early cache before they expire,
+// independent of client traffic.
+type hotRefresher struct {
+	amount   int // Minimum number of hits within the prefetch duration
+	interval time.Duration
+	stopCh   chan struct{}
+	doneCh   chan struct{}
+}
+
+// startHotRefresh starts refreshing the hot names every c.hotRefresh.interval.
+func (c *Cache) startHotRefresh() {
+	h := c.hotRefresh
+	h.stopCh = make(chan struct{})
+	h.doneCh = make(chan struct{})
+	go func() {
+		defer close(h.doneCh)
+		ticker := time.NewTicker(h.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-h.stopCh:
+				return
+			case <-ticker.C:
+				c.refreshHot(c.now().UTC())
+			}
+		}
+	}()
+}
+
+// stopHotRefresh stops refreshing the hot names.
+func (c *Cache) stopHotRefresh() {
+	if c.hotRefresh == nil || c.hotRefresh.stopCh == nil {
+		return
+	}
+	close(c.hotRefresh.stopCh)
+	<-c.hotRefresh.doneCh
+}
+
+// refreshHot prefetches the items in the early positive cache that were hit at least
+// c.hotRefresh.amount times within the prefetch duration, and would otherwise expire, or reach the
+// prefetch percentage, before the next run. It returns the number of prefetched items.
+func (c *Cache) refreshHot(now time.Time) int {
+	h := c.hotRefresh
+	keys, items := walkItems(c.pcache, func(i *item) bool {
+		if i.Freq.Hits() < h.amount || now.Sub(i.Freq.Last()) > c.duration {
+			return false
+		}
+		threshold := int(math.Ceil(float64(c.percentage)/100*float64(i.origTTL)) + h.interval.Seconds())
+		ttl := i.ttl(now)
+		return ttl > 0 && ttl <= threshold
+	})
+	n := 0
+	for j, i := range items {
+		state, ok := refreshRequest(keys[j], i)
+		if !ok {
+			continue
+		}
+		cw := newPrefetchResponseWriter("", state, c)
+		// Keep the time of the last hit, so names that are no longer queried cool down.
+		c.schedulePrefetch(context.Background(), state, cw, i, i.Freq.Last(), true)
+		hotRefreshes.Inc()
+		n++
+	}
+	return n
+}
+
+// refreshRequest returns a request for the cached item i stored under key. The DO and CD bits are
+// recovered from key.
+func refreshRequest(key uint64, i *item) (request.Request, bool) {
+	do, cd, ok := i.keyBits(key)
+	if !ok {
+		return request.Request{}, false
+	}
+	return newRefreshRequest(i.Name, i.QType, do, cd), true
+}
+
+// newRefreshRequest returns a request for a background refresh of name and qtype.
+func newRefreshRequest(name string, qtype uint16, do, cd bool) request.Request {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.CheckingDisabled = cd
+	if do {
+		m.SetEdns0(4096, true)
+	}
+	return request.Request{W: refreshResponseWriter{}, Req: m}
+}
+
+// refreshResponseWriter is the client of background refreshes. Nothing is written to it.
+type refreshResponseWriter struct{}
+
+var refreshAddr = &net.TCPAddr{IP: net.IPv6loopback, Port: 53}
+
+func (refreshResponseWriter) LocalAddr() net.Addr         { return refreshAddr }
+func (refreshResponseWriter) RemoteAddr() net.Addr        { return refreshAddr }
+func (refreshResponseWriter) WriteMsg(*dns.Msg) error     { return nil }
+func (refreshResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (refreshResponseWriter) Close() error                { return nil }
+func (refreshResponseWriter) TsigStatus() error           { return nil }
+func (refreshResponseWriter) TsigTimersOnly(bool)         {}
+func (refreshResponseWriter) Hijack()                     {}
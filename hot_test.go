@@ -0,0 +1,75 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+func TestHotRefresh(t *testing.T) {
+	c := newTestK8sCache(true)
+	c.hotRefresh = &hotRefresher{amount: 2, interval: time.Second}
+	c.duration = 10 * time.Second
+	c.Next = ttlBackend(10)
+	start := time.Now()
+	c.now = func() time.Time { return start }
+
+	ctx := context.TODO()
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	for n := 0; n < 3; n++ {
+		// A miss, and two hits
+		c.ServeDNS(ctx, dnstest.NewRecorder(&test.ResponseWriter{}), req.Copy())
+	}
+	c.Next = ttlBackend(20)
+
+	tests := []struct {
+		futureSeconds int
+		amount        int
+		refreshed     int
+	}{
+		{2, 2, 0}, // Not expiring before the next run
+		{8, 3, 0}, // Not popular enough
+		{8, 2, 1},
+		{19, 2, 0}, // No longer queried
+	}
+	for i, tt := range tests {
+		c.hotRefresh.amount = tt.amount
+		if n := c.refreshHot(start.Add(time.Duration(tt.futureSeconds) * time.Second)); n != tt.refreshed {
+			t.Errorf("Test %d: expected %d refreshed names, got %d", i, tt.refreshed, n)
+		}
+		if tt.refreshed > 0 {
+			waitFor(t, "refreshed item", func() bool {
+				i := c.exists(request.Request{W: &test.ResponseWriter{}, Req: req})
+				return i != nil && i.origTTL == 20
+			})
+		}
+	}
+}
+
+func TestRefreshRequest(t *testing.T) {
+	// Keys are built from the lowercased qname
+	for _, name := range []string{"example.org.", "Example.ORG."} {
+		for _, do := range []bool{false, true} {
+			for _, cd := range []bool{false, true} {
+				i := &item{Name: name, QType: dns.TypeAAAA}
+				state, ok := refreshRequest(hash("example.org.", i.QType, do, cd), i)
+				if !ok {
+					t.Fatalf("Expected request for %s do=%t cd=%t", name, do, cd)
+				}
+				if state.Name() != "example.org." || state.QType() != i.QType || state.Do() != do || state.Req.CheckingDisabled != cd {
+					t.Errorf("Expected request for %s do=%t cd=%t, got %s", name, do, cd, state.Req)
+				}
+			}
+		}
+	}
+	if _, ok := refreshRequest(hash("other.org.", dns.TypeAAAA, false, false), &item{Name: "example.org.", QType: dns.TypeAAAA}); ok {
+		t.Errorf("Expected no request for the key of another question")
+	}
+}
@@ -4,8 +4,8 @@ import (
 	"strings"
 	"time"
 
-	"github.com/coredns/coredns/plugin/cache/freq"
 	"github.com/coredns/coredns/request"
+	"github.com/delta10/k8s_cache/freq"
 
 	"github.com/miekg/dns"
 )
@@ -94,14 +94,62 @@ func (i *item) toMsg(m *dns.Msg, now time.Time, do bool, ad bool) *dns.Msg {
 	return m1
 }
 
+// pack returns i in wire format, as a reply message to the question it holds.
+func (i *item) pack() ([]byte, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(i.Name, i.QType)
+	m.Response = true
+	m.Rcode = i.Rcode
+	m.AuthenticatedData = i.AuthenticatedData
+	m.RecursionAvailable = i.RecursionAvailable
+	m.Answer = i.Answer
+	m.Ns = i.Ns
+	m.Extra = i.Extra
+	return m.Pack()
+}
+
 func (i *item) ttl(now time.Time) int {
 	ttl := int(i.origTTL) - int(now.UTC().Sub(i.stored).Seconds())
 	return ttl
 }
 
+// denial returns true if i is a denial of existence, i.e. a NXDOMAIN or NODATA response.
+func (i *item) denial() bool {
+	if i.Rcode == dns.RcodeNameError {
+		return true
+	}
+	if i.Rcode != dns.RcodeSuccess || len(i.Answer) > 0 {
+		return false
+	}
+	for _, r := range i.Ns {
+		if r.Header().Rrtype == dns.TypeSOA {
+			return true
+		}
+	}
+	return false
+}
+
 func (i *item) matches(state request.Request) bool {
 	if state.QType() == i.QType && strings.EqualFold(state.QName(), i.Name) {
 		return true
 	}
 	return false
 }
+
+// keyBits returns the DO and CD bits with which key is the key of the question of item i, and
+// false if it isn't its key with any of them.
+func (i *item) keyBits(key uint64) (do, cd, ok bool) {
+	if i.Name == "" {
+		return false, false, false
+	}
+	// Keys are built from the lowercased qname
+	name := strings.ToLower(i.Name)
+	for _, d := range []bool{false, true} {
+		for _, c := range []bool{false, true} {
+			if hash(name, i.QType, d, c) == key {
+				return d, c, true
+			}
+		}
+	}
+	return false, false, false
+}
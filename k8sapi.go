@@ -1,10 +1,17 @@
 package cache
 
 import (
+	"context"
+	"net/netip"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	kcache "k8s.io/client-go/tools/cache"
@@ -14,11 +21,51 @@ import (
 	clog "github.com/coredns/coredns/plugin/pkg/log"
 )
 
+// defaultEarlyRefreshSelector selects the pods that receive early refreshes when no
+// early_refresh_selector is configured.
+const defaultEarlyRefreshSelector = "k8s-cache.coredns.io/early-refresh=true"
+
+// earlyRefreshLeadAnnotation lets an early refresh pod declare how long before normal clients it
+// needs fresh answers, e.g. "10s". The earlyrefresh duration is the default and maximum.
+const earlyRefreshLeadAnnotation = "k8s-cache.coredns.io/early-refresh-lead"
+
+const (
+	defaultResyncPeriod = 10 * time.Second
+	defaultSyncTimeout  = 5 * time.Second
+)
+
+// podIPIndex is the name of the index on the IP addresses of pods in a pod store.
+const podIPIndex = "podIP"
+
 type k8sAPI struct {
-	// Client cache for the Kubernetes API
-	store         kcache.Store
-	reflector     *kcache.Reflector
-	reflectorChan chan struct{}
+	client kubernetes.Interface
+
+	// Client cache for the Kubernetes API, one pod informer per watched namespace
+	podWatchers map[string]*podWatcher
+	mu          sync.RWMutex
+
+	// Namespace informer, only used when namespaceSelector is set
+	nsInformer kcache.SharedIndexInformer
+	nsSynced   kcache.InformerSynced
+	stopChan   chan struct{}
+
+	// Set once all informers have completed their initial sync
+	synced atomic.Bool
+
+	// Label selector for pods that should receive early refreshes
+	labelSelector labels.Selector
+	// Namespaces in which early refresh pods are watched, all namespaces if empty
+	namespaces []string
+	// Label selector for the namespaces in which early refresh pods are watched
+	namespaceSelector labels.Selector
+	// Maximum time to wait for the initial sync on startup
+	syncTimeout time.Duration
+	// ServiceAccounts, as namespace/name, that early refresh pods must run as; any if empty
+	serviceAccounts map[string]struct{}
+
+	// Watch all pods, to detect early refresh pod IPs that were reused by other pods
+	detectCollisions bool
+	allPods          kcache.SharedIndexInformer
 
 	// Kubernetes credentials (copied from Kubernetes plugin)
 	APIServerList []string
@@ -27,28 +74,351 @@ type k8sAPI struct {
 	APIClientKey  string
 }
 
-func newK8sAPI() (*k8sAPI, error) {
-	k := new(k8sAPI)
+// podWatcher keeps a store of the early refresh pods in a single namespace, indexed by pod IP.
+type podWatcher struct {
+	informer kcache.SharedIndexInformer
+	store    kcache.Indexer
+	stopChan chan struct{}
+}
+
+func newK8sAPI() *k8sAPI {
+	selector, _ := labels.Parse(defaultEarlyRefreshSelector)
+	return &k8sAPI{
+		podWatchers:   make(map[string]*podWatcher),
+		labelSelector: selector,
+		syncTimeout:   defaultSyncTimeout,
+	}
+}
+
+// start connects to the Kubernetes API and starts watching the pods selected by k.labelSelector.
+func (k *k8sAPI) start() error {
 	clientset, err := k.getKubernetesClient()
 	if err != nil {
-		return k, err
+		return err
 	}
+	k.client = clientset
+	return k.run()
+}
+
+// run starts the informers using k.client.
+func (k *k8sAPI) run() error {
+	k.stopChan = make(chan struct{})
+
+	if k.detectCollisions {
+		k.watchAllPods()
+	}
+	if k.namespaceSelector != nil {
+		return k.watchNamespaces()
+	}
+
+	namespaces := k.namespaces
+	if len(namespaces) == 0 {
+		namespaces = []string{metav1.NamespaceAll}
+	}
+	for _, ns := range namespaces {
+		k.addPodWatcher(ns)
+	}
+	return nil
+}
 
-	optionsModifier := func(options *metav1.ListOptions) {
-		options.LabelSelector = "k8s-cache.coredns.io/early-refresh=true"
+// stop stops all watches on the Kubernetes API.
+func (k *k8sAPI) stop() {
+	if k.stopChan == nil {
+		return
 	}
-	lw := kcache.NewFilteredListWatchFromClient(
-		clientset.CoreV1().RESTClient(),
-		"pods",
-		metav1.NamespaceAll,
-		optionsModifier,
-	)
+	close(k.stopChan)
 
-	k.store, k.reflector = kcache.NewNamespaceKeyedIndexerAndReflector(lw, &v1.Pod{}, time.Second*10)
-	k.reflectorChan = make(chan struct{})
-	go k.reflector.Run(k.reflectorChan)
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for ns, pw := range k.podWatchers {
+		close(pw.stopChan)
+		delete(k.podWatchers, ns)
+	}
+}
 
-	return k, nil
+// waitForSync waits until all informers have synced, at most for k.syncTimeout. It returns
+// whether the informers have synced.
+func (k *k8sAPI) waitForSync() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), k.syncTimeout)
+	defer cancel()
+	return kcache.WaitForCacheSync(ctx.Done(), k.hasSynced)
+}
+
+// hasSynced returns true once all informers have completed their initial list of the Kubernetes API.
+func (k *k8sAPI) hasSynced() bool {
+	if k.synced.Load() {
+		return true
+	}
+	if k.nsSynced != nil && !k.nsSynced() {
+		return false
+	}
+	if k.allPods != nil && !k.allPods.HasSynced() {
+		return false
+	}
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if k.stopChan == nil {
+		return false
+	}
+	for _, pw := range k.podWatchers {
+		if !pw.informer.HasSynced() {
+			return false
+		}
+	}
+	k.synced.Store(true)
+	return true
+}
+
+// watchNamespaces watches the namespaces selected by k.namespaceSelector, and starts or stops
+// watching the pods in a namespace when it is added or removed.
+func (k *k8sAPI) watchNamespaces() error {
+	lw := &kcache.ListWatch{
+		ListFunc:  namespaceListFunc(context.Background(), k.client, k.namespaceSelector),
+		WatchFunc: namespaceWatchFunc(context.Background(), k.client, k.namespaceSelector),
+	}
+	k.nsInformer = kcache.NewSharedIndexInformer(lw, &v1.Namespace{}, defaultResyncPeriod, kcache.Indexers{})
+	registration, err := k.nsInformer.AddEventHandler(kcache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if ns, ok := obj.(*v1.Namespace); ok {
+				k.addPodWatcher(ns.Name)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(kcache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if ns, ok := obj.(*v1.Namespace); ok {
+				k.removePodWatcher(ns.Name)
+			}
+		},
+	})
+	if err != nil {
+		return err
+	}
+	// The pod informers are only known after the handler has processed the initial namespace list.
+	k.nsSynced = registration.HasSynced
+	go k.nsInformer.Run(k.stopChan)
+	return nil
+}
+
+// watchAllPods watches all pods, indexed by IP, to detect IP addresses of early refresh pods that
+// are also used by other pods.
+func (k *k8sAPI) watchAllPods() {
+	lw := &kcache.ListWatch{
+		ListFunc:  podListFunc(context.Background(), k.client, metav1.NamespaceAll, nil),
+		WatchFunc: podWatchFunc(context.Background(), k.client, metav1.NamespaceAll, nil),
+	}
+	k.allPods = kcache.NewSharedIndexInformer(lw, &v1.Pod{}, defaultResyncPeriod, kcache.Indexers{podIPIndex: podNetworkIPIndexFunc})
+	k.allPods.AddEventHandler(kcache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { k.updateIPsMetric() },
+		UpdateFunc: func(interface{}, interface{}) { k.updateIPsMetric() },
+		DeleteFunc: func(interface{}) { k.updateIPsMetric() },
+	})
+	go k.allPods.Run(k.stopChan)
+}
+
+// newPodWatcher returns a podWatcher for the early refresh pods in namespace. It is not started.
+func (k *k8sAPI) newPodWatcher(namespace string) *podWatcher {
+	lw := &kcache.ListWatch{
+		ListFunc:  podListFunc(context.Background(), k.client, namespace, k.labelSelector),
+		WatchFunc: podWatchFunc(context.Background(), k.client, namespace, k.labelSelector),
+	}
+	pw := &podWatcher{
+		informer: kcache.NewSharedIndexInformer(lw, &v1.Pod{}, defaultResyncPeriod, kcache.Indexers{podIPIndex: k.allowedPodIPIndexFunc}),
+		stopChan: make(chan struct{}),
+	}
+	pw.store = pw.informer.GetIndexer()
+	return pw
+}
+
+// addPodWatcher starts watching the early refresh pods in namespace, if not already watched.
+func (k *k8sAPI) addPodWatcher(namespace string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, ok := k.podWatchers[namespace]; ok {
+		return
+	}
+	pw := k.newPodWatcher(namespace)
+	pw.informer.AddEventHandler(kcache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			k.checkServiceAccount(nil, obj)
+			k.updateIPsMetric()
+		},
+		UpdateFunc: func(old, obj interface{}) {
+			k.checkServiceAccount(old, obj)
+			k.updateIPsMetric()
+		},
+		DeleteFunc: func(interface{}) { k.updateIPsMetric() },
+	})
+	k.podWatchers[namespace] = pw
+	go pw.informer.Run(pw.stopChan)
+}
+
+// removePodWatcher stops watching the early refresh pods in namespace and forgets them.
+func (k *k8sAPI) removePodWatcher(namespace string) {
+	k.mu.Lock()
+	if pw, ok := k.podWatchers[namespace]; ok {
+		close(pw.stopChan)
+		delete(k.podWatchers, namespace)
+	}
+	k.mu.Unlock()
+	k.updateIPsMetric()
+}
+
+// updateIPsMetric sets the number of known early refresh pod IPs, and the number of those IPs that
+// are also used by other pods.
+func (k *k8sAPI) updateIPsMetric() {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	n, collisions := 0, 0
+	for _, pw := range k.podWatchers {
+		for _, ip := range pw.store.ListIndexFuncValues(podIPIndex) {
+			n++
+			items, _ := pw.store.ByIndex(podIPIndex, ip)
+			for _, item := range items {
+				if pod, ok := item.(*v1.Pod); ok && k.ipConflict(pod, ip) != nil {
+					collisions++
+					break
+				}
+			}
+		}
+	}
+	earlyRefreshIPs.Set(float64(n))
+	earlyRefreshIPCollisions.Set(float64(collisions))
+}
+
+// podRunning returns whether pod is running and not terminating. Other pods may have released
+// their IP addresses, to be reused by new pods.
+func podRunning(pod *v1.Pod) bool {
+	return pod.Status.Phase == v1.PodRunning && pod.DeletionTimestamp == nil
+}
+
+// ipConflict returns the most recent other running pod that has ip, if any. It always returns nil
+// if not all pods are watched.
+func (k *k8sAPI) ipConflict(pod *v1.Pod, ip string) *v1.Pod {
+	if k.allPods == nil {
+		return nil
+	}
+	items, err := k.allPods.GetIndexer().ByIndex(podIPIndex, ip)
+	if err != nil {
+		return nil
+	}
+	var other *v1.Pod
+	for _, item := range items {
+		p, ok := item.(*v1.Pod)
+		if !ok || !podRunning(p) || (p.Namespace == pod.Namespace && p.Name == pod.Name) {
+			continue
+		}
+		if other == nil || p.CreationTimestamp.After(other.CreationTimestamp.Time) {
+			other = p
+		}
+	}
+	return other
+}
+
+// hasIP returns whether the early refresh pod still has ip. If another running pod has the same
+// IP, the most recent of both has it.
+func (k *k8sAPI) hasIP(pod *v1.Pod, ip string) bool {
+	other := k.ipConflict(pod, ip)
+	return other == nil || !other.CreationTimestamp.After(pod.CreationTimestamp.Time)
+}
+
+// podAllowed returns whether pod runs as one of the allowed service accounts, if any are
+// configured.
+func (k *k8sAPI) podAllowed(pod *v1.Pod) bool {
+	if len(k.serviceAccounts) == 0 {
+		return true
+	}
+	sa := pod.Spec.ServiceAccountName
+	if sa == "" {
+		sa = "default"
+	}
+	_, ok := k.serviceAccounts[pod.Namespace+"/"+sa]
+	return ok
+}
+
+// checkServiceAccount logs and counts a selected pod that is not allowed to get early refreshes,
+// when it is added, or when it is no longer allowed after an update from old.
+func (k *k8sAPI) checkServiceAccount(old, obj interface{}) {
+	pod, ok := obj.(*v1.Pod)
+	if !ok || k.podAllowed(pod) {
+		return
+	}
+	if oldPod, ok := old.(*v1.Pod); ok && !k.podAllowed(oldPod) {
+		return
+	}
+	log.Warningf("Pod %s/%s is selected for early refreshes, but its service account %q is not allowed", pod.Namespace, pod.Name, pod.Spec.ServiceAccountName)
+	rejectedPods.Inc()
+}
+
+// allowedPodIPIndexFunc indexes running pods that are allowed to get early refreshes on their IP
+// addresses.
+func (k *k8sAPI) allowedPodIPIndexFunc(obj interface{}) ([]string, error) {
+	if pod, ok := obj.(*v1.Pod); ok && (!podRunning(pod) || !k.podAllowed(pod)) {
+		return nil, nil
+	}
+	return podIPIndexFunc(obj)
+}
+
+// podNetworkIPIndexFunc indexes pods on their IP addresses, except pods on the host network, which
+// share the IP addresses of their node.
+func podNetworkIPIndexFunc(obj interface{}) ([]string, error) {
+	if pod, ok := obj.(*v1.Pod); ok && pod.Spec.HostNetwork {
+		return nil, nil
+	}
+	return podIPIndexFunc(obj)
+}
+
+// podIPIndexFunc indexes pods on their IP addresses, in canonical form.
+func podIPIndexFunc(obj interface{}) ([]string, error) {
+	pod, ok := obj.(*v1.Pod)
+	if !ok {
+		return nil, nil
+	}
+	ips := make([]string, 0, len(pod.Status.PodIPs))
+	for _, podIP := range pod.Status.PodIPs {
+		if addr, err := netip.ParseAddr(podIP.IP); err == nil {
+			ips = append(ips, addr.Unmap().String())
+		}
+	}
+	return ips, nil
+}
+
+func podListFunc(ctx context.Context, c kubernetes.Interface, ns string, s labels.Selector) func(metav1.ListOptions) (runtime.Object, error) {
+	return func(opts metav1.ListOptions) (runtime.Object, error) {
+		if s != nil {
+			opts.LabelSelector = s.String()
+		}
+		return c.CoreV1().Pods(ns).List(ctx, opts)
+	}
+}
+
+func podWatchFunc(ctx context.Context, c kubernetes.Interface, ns string, s labels.Selector) func(metav1.ListOptions) (watch.Interface, error) {
+	return func(opts metav1.ListOptions) (watch.Interface, error) {
+		if s != nil {
+			opts.LabelSelector = s.String()
+		}
+		return c.CoreV1().Pods(ns).Watch(ctx, opts)
+	}
+}
+
+func namespaceListFunc(ctx context.Context, c kubernetes.Interface, s labels.Selector) func(metav1.ListOptions) (runtime.Object, error) {
+	return func(opts metav1.ListOptions) (runtime.Object, error) {
+		if s != nil {
+			opts.LabelSelector = s.String()
+		}
+		return c.CoreV1().Namespaces().List(ctx, opts)
+	}
+}
+
+func namespaceWatchFunc(ctx context.Context, c kubernetes.Interface, s labels.Selector) func(metav1.ListOptions) (watch.Interface, error) {
+	return func(opts metav1.ListOptions) (watch.Interface, error) {
+		if s != nil {
+			opts.LabelSelector = s.String()
+		}
+		return c.CoreV1().Namespaces().Watch(ctx, opts)
+	}
 }
 
 func (k *k8sAPI) getKubernetesClient() (*kubernetes.Clientset, error) {
@@ -106,20 +476,42 @@ func (k *k8sAPI) getClientConfig() (*rest.Config, error) {
 	return cc, err
 }
 
-// Get all IP addresses of all pods selected by k.reflector, i.e. those who should receive early cache refreshes.
-func (k *k8sAPI) getEarlyRefreshIPs() []string {
-	items := k.store.List()
-	ips := make([]string, 0, len(items))
-	for _, item := range items {
-		pod, ok := item.(*v1.Pod)
+// earlyRefreshPod returns the early refresh pod with IP address ip, or nil if there is none.
+// The lookup uses the pod IP index, so its cost does not depend on the number of pods.
+func (k *k8sAPI) earlyRefreshPod(ip string) *v1.Pod {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	for _, pw := range k.podWatchers {
+		items, err := pw.store.ByIndex(podIPIndex, ip)
+		if err != nil || len(items) == 0 {
+			continue
+		}
+		pod, ok := items[0].(*v1.Pod)
 		if !ok {
 			log := clog.NewWithPlugin("k8s_cache")
 			log.Errorf("Cache item is not a *v1.Pod")
 			return nil
 		}
-		for ip := range pod.Status.PodIPs {
-			ips = append(ips, pod.Status.PodIPs[ip].IP)
+		if !k.hasIP(pod, ip) {
+			// The IP was reused by a more recent pod
+			return nil
 		}
+		return pod
+	}
+	return nil
+}
+
+// podLead returns the lead declared by pod with the early refresh lead annotation, truncated to whole
+// seconds. It returns false if the pod has no valid annotation.
+func podLead(pod *v1.Pod) (time.Duration, bool) {
+	v, ok := pod.Annotations[earlyRefreshLeadAnnotation]
+	if !ok {
+		return 0, false
+	}
+	lead, err := time.ParseDuration(v)
+	if err != nil || lead < 0 {
+		return 0, false
 	}
-	return ips
+	return lead.Truncate(time.Second), true
 }
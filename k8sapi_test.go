@@ -0,0 +1,321 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func earlyRefreshPod(namespace, name, ip string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels: map[string]string{
+				"k8s-cache.coredns.io/early-refresh": "true",
+			},
+		},
+		Status: v1.PodStatus{
+			Phase: v1.PodRunning,
+			PodIPs: []v1.PodIP{
+				{IP: ip},
+			},
+		},
+	}
+}
+
+func testNamespace(name string, l map[string]string) *v1.Namespace {
+	return &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: l}}
+}
+
+// waitFor polls cond until it returns true or a timeout expires.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (k *k8sAPI) hasPodWatcher(namespace string) bool {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	_, ok := k.podWatchers[namespace]
+	return ok
+}
+
+func TestEarlyRefreshPodNamespaces(t *testing.T) {
+	k := newK8sAPI()
+	k.client = fake.NewSimpleClientset()
+	k.namespaces = []string{"team-a", "team-b"}
+	for _, ns := range k.namespaces {
+		k.podWatchers[ns] = k.newPodWatcher(ns)
+	}
+	k.podWatchers["team-a"].store.Add(earlyRefreshPod("team-a", "controller", "10.0.0.1"))
+	k.podWatchers["team-b"].store.Add(earlyRefreshPod("team-b", "controller", "10.0.0.2"))
+
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+		if pod := k.earlyRefreshPod(ip); pod == nil {
+			t.Errorf("Expected early refresh pod for %s", ip)
+		}
+	}
+}
+
+func TestNamespaceLabels(t *testing.T) {
+	selected := map[string]string{"dns-early-refresh": "enabled"}
+	client := fake.NewSimpleClientset(
+		testNamespace("selected", selected),
+		testNamespace("ignored", nil),
+		earlyRefreshPod("selected", "controller", "10.0.0.1"),
+		earlyRefreshPod("ignored", "controller", "10.0.0.2"),
+	)
+
+	k := newK8sAPI()
+	k.client = client
+	k.namespaceSelector, _ = labels.Parse("dns-early-refresh=enabled")
+	k.stopChan = make(chan struct{})
+	defer k.stop()
+	k.watchNamespaces()
+
+	waitFor(t, "early refresh pod in selected namespace", func() bool {
+		return k.earlyRefreshPod("10.0.0.1") != nil
+	})
+	if pod := k.earlyRefreshPod("10.0.0.2"); pod != nil {
+		t.Errorf("Expected no early refresh pod in namespace without matching labels, got %s/%s", pod.Namespace, pod.Name)
+	}
+	if k.hasPodWatcher("ignored") {
+		t.Errorf("Expected no pod watcher for namespace without matching labels")
+	}
+
+	if err := client.CoreV1().Namespaces().Delete(context.TODO(), "selected", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "pod watcher of deleted namespace to be removed", func() bool {
+		return !k.hasPodWatcher("selected")
+	})
+	if pod := k.earlyRefreshPod("10.0.0.1"); pod != nil {
+		t.Errorf("Expected no early refresh pod after namespace deletion, got %s/%s", pod.Namespace, pod.Name)
+	}
+}
+
+func TestEarlyRefreshPod(t *testing.T) {
+	k := newK8sAPI()
+	k.client = fake.NewSimpleClientset()
+	k.podWatchers["team-a"] = k.newPodWatcher("team-a")
+	k.podWatchers["team-b"] = k.newPodWatcher("team-b")
+	k.podWatchers["team-a"].store.Add(earlyRefreshPod("team-a", "controller", "10.0.0.1"))
+	dualStack := earlyRefreshPod("team-b", "controller", "10.0.0.2")
+	dualStack.Status.PodIPs = append(dualStack.Status.PodIPs, v1.PodIP{IP: "fd00::2"})
+	k.podWatchers["team-b"].store.Add(dualStack)
+
+	tests := []struct {
+		ip       string
+		expected string
+	}{
+		{"10.0.0.1", "team-a/controller"},
+		{"10.0.0.2", "team-b/controller"},
+		{"fd00::2", "team-b/controller"},
+		{"10.0.0.3", ""},
+		{"fd00::3", ""},
+	}
+	for i, tt := range tests {
+		got := ""
+		if pod := k.earlyRefreshPod(tt.ip); pod != nil {
+			got = pod.Namespace + "/" + pod.Name
+		}
+		if got != tt.expected {
+			t.Errorf("Test %d: expected pod %q for %s, got %q", i, tt.expected, tt.ip, got)
+		}
+	}
+
+	k.podWatchers["team-a"].store.Delete(earlyRefreshPod("team-a", "controller", "10.0.0.1"))
+	if pod := k.earlyRefreshPod("10.0.0.1"); pod != nil {
+		t.Errorf("Expected no pod for 10.0.0.1 after deletion, got %s/%s", pod.Namespace, pod.Name)
+	}
+}
+
+// BenchmarkNeedEarlyRefresh shows that the cost of NeedEarlyRefresh does not depend on the
+// number of early refresh pods.
+func BenchmarkNeedEarlyRefresh(b *testing.B) {
+	for _, pods := range []int{10, 100, 1000, 10000} {
+		b.Run(fmt.Sprintf("pods=%d", pods), func(b *testing.B) {
+			c := newTestK8sCache(true)
+			store := c.k8sAPI.podWatchers[metav1.NamespaceAll].store
+			for i := 0; i < pods; i++ {
+				store.Add(earlyRefreshPod("default", fmt.Sprintf("pod-%d", i), fmt.Sprintf("10.1.%d.%d", i/256, i%256)))
+			}
+			req := new(dns.Msg)
+			req.SetQuestion("example.org.", dns.TypeA)
+			state := request.Request{W: &test.ResponseWriter{}, Req: req}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if !c.NeedEarlyRefresh(state) {
+					b.Fatal("Expected early refresh")
+				}
+			}
+		})
+	}
+}
+
+func TestWaitForSync(t *testing.T) {
+	k := newK8sAPI()
+	k.client = fake.NewSimpleClientset(earlyRefreshPod("default", "controller", "10.0.0.1"))
+	if k.hasSynced() {
+		t.Fatalf("Expected k8sAPI not to be synced before it is started")
+	}
+	if err := k.run(); err != nil {
+		t.Fatal(err)
+	}
+	defer k.stop()
+
+	if !k.waitForSync() {
+		t.Fatalf("Expected k8sAPI to sync within %s", k.syncTimeout)
+	}
+	if pod := k.earlyRefreshPod("10.0.0.1"); pod == nil {
+		t.Errorf("Expected early refresh pod to be known after sync")
+	}
+}
+
+func TestWaitForSyncNamespaceLabels(t *testing.T) {
+	k := newK8sAPI()
+	k.client = fake.NewSimpleClientset(
+		testNamespace("selected", map[string]string{"dns-early-refresh": "enabled"}),
+		earlyRefreshPod("selected", "controller", "10.0.0.1"),
+	)
+	k.namespaceSelector, _ = labels.Parse("dns-early-refresh=enabled")
+	if err := k.run(); err != nil {
+		t.Fatal(err)
+	}
+	defer k.stop()
+
+	if !k.waitForSync() {
+		t.Fatalf("Expected k8sAPI to sync within %s", k.syncTimeout)
+	}
+	if pod := k.earlyRefreshPod("10.0.0.1"); pod == nil {
+		t.Errorf("Expected early refresh pod in selected namespace to be known after sync")
+	}
+}
+
+func TestServiceAccounts(t *testing.T) {
+	allowed := earlyRefreshPod("team-a", "controller", "10.0.0.1")
+	allowed.Spec.ServiceAccountName = "fqdn-controller"
+	other := earlyRefreshPod("team-a", "intruder", "10.0.0.2")
+	other.Spec.ServiceAccountName = "intruder"
+	otherNamespace := earlyRefreshPod("team-b", "controller", "10.0.0.3")
+	otherNamespace.Spec.ServiceAccountName = "fqdn-controller"
+	defaultAccount := earlyRefreshPod("team-b", "default", "10.0.0.4")
+
+	k := newK8sAPI()
+	k.client = fake.NewSimpleClientset(allowed, other, otherNamespace, defaultAccount)
+	k.serviceAccounts = map[string]struct{}{"team-a/fqdn-controller": {}, "team-b/default": {}}
+	k.stopChan = make(chan struct{})
+	defer k.stop()
+	rejected := testutil.ToFloat64(rejectedPods)
+	k.addPodWatcher(metav1.NamespaceAll)
+	waitFor(t, "pod watcher to sync", k.hasSynced)
+
+	tests := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"10.0.0.1", true},
+		{"10.0.0.2", false}, // Other service account
+		{"10.0.0.3", false}, // Service account of another namespace
+		{"10.0.0.4", true},  // Default service account
+	}
+	for i, tt := range tests {
+		if allowed := k.earlyRefreshPod(tt.ip) != nil; allowed != tt.allowed {
+			t.Errorf("Test %d: expected early refresh %t for %s, got %t", i, tt.allowed, tt.ip, allowed)
+		}
+	}
+	waitFor(t, "rejected pods to be counted", func() bool { return testutil.ToFloat64(rejectedPods)-rejected == 2 })
+}
+
+func TestEarlyRefreshPodPhase(t *testing.T) {
+	k := newK8sAPI()
+	k.client = fake.NewSimpleClientset()
+	k.podWatchers[metav1.NamespaceAll] = k.newPodWatcher(metav1.NamespaceAll)
+	pending := earlyRefreshPod("team-a", "pending", "10.0.0.1")
+	pending.Status.Phase = v1.PodPending
+	succeeded := earlyRefreshPod("team-a", "succeeded", "10.0.0.2")
+	succeeded.Status.Phase = v1.PodSucceeded
+	terminating := earlyRefreshPod("team-a", "terminating", "10.0.0.3")
+	terminating.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+	for _, pod := range []*v1.Pod{pending, succeeded, terminating, earlyRefreshPod("team-a", "running", "10.0.0.4")} {
+		k.podWatchers[metav1.NamespaceAll].store.Add(pod)
+	}
+
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		if pod := k.earlyRefreshPod(ip); pod != nil {
+			t.Errorf("Expected no early refresh pod for %s, got %s", ip, pod.Name)
+		}
+	}
+	if pod := k.earlyRefreshPod("10.0.0.4"); pod == nil || pod.Name != "running" {
+		t.Errorf("Expected running early refresh pod for 10.0.0.4, got %v", pod)
+	}
+}
+
+func TestIPCollisions(t *testing.T) {
+	now := time.Now()
+	older := earlyRefreshPod("team-a", "controller", "10.0.0.1")
+	older.CreationTimestamp = metav1.Time{Time: now.Add(-time.Hour)}
+	reused := earlyRefreshPod("team-b", "unrelated", "10.0.0.1") // Got the IP later
+	reused.Labels = nil
+	reused.CreationTimestamp = metav1.Time{Time: now}
+	newer := earlyRefreshPod("team-a", "monitor", "10.0.0.2")
+	newer.CreationTimestamp = metav1.Time{Time: now}
+	stale := earlyRefreshPod("team-b", "old", "10.0.0.2")
+	stale.Labels = nil
+	stale.CreationTimestamp = metav1.Time{Time: now.Add(-time.Hour)}
+	hostNetwork := earlyRefreshPod("team-b", "node-agent", "10.0.0.3")
+	hostNetwork.Labels = nil
+	hostNetwork.Spec.HostNetwork = true
+	hostNetwork.CreationTimestamp = metav1.Time{Time: now}
+	single := earlyRefreshPod("team-a", "single", "10.0.0.3")
+	single.CreationTimestamp = metav1.Time{Time: now.Add(-time.Hour)}
+
+	k := newK8sAPI()
+	k.client = fake.NewSimpleClientset(older, reused, newer, stale, hostNetwork, single)
+	k.detectCollisions = true
+	if err := k.run(); err != nil {
+		t.Fatal(err)
+	}
+	defer k.stop()
+	waitFor(t, "informers to sync", k.hasSynced)
+
+	tests := []struct {
+		ip       string
+		expected string
+	}{
+		{"10.0.0.1", ""},        // Reused by a more recent pod
+		{"10.0.0.2", "monitor"}, // Most recent pod with the IP
+		{"10.0.0.3", "single"},  // Pods on the host network don't collide
+	}
+	for i, tt := range tests {
+		got := ""
+		if pod := k.earlyRefreshPod(tt.ip); pod != nil {
+			got = pod.Name
+		}
+		if got != tt.expected {
+			t.Errorf("Test %d: expected pod %q for %s, got %q", i, tt.expected, tt.ip, got)
+		}
+	}
+	waitFor(t, "collisions metric", func() bool { return testutil.ToFloat64(earlyRefreshIPCollisions) == 2 })
+}
@@ -1,22 +1,98 @@
 package cache 
 
 import (
+	"net/http"
+	"sync"
 	"time"
 
+	"github.com/coredns/coredns/plugin"
 	"github.com/coredns/coredns/plugin/pkg/cache"
 	"github.com/coredns/coredns/request"
 
 	"github.com/miekg/dns"
 )
 
+// Default duration after expiry in which late items are served on upstream failure
+const defaultLateFallback = 1 * time.Hour
+
 type Cache struct {
 	*CacheBackend
 
 	// Late positive cache. CacheBackend.pcache is the early cache
 	latepcache  *cache.Cache
 	extrattl		time.Duration
+	// Zone specific early refresh durations, overriding extrattl
+	zonettls  map[string]time.Duration
+	ttlzones  []string
+	// Only names in earlyZones, if any, and not in excludeZones get early refreshes
+	earlyZones   []string
+	excludeZones []string
+
+	// Late negative cache, only used if latedenial is set. CacheBackend.ncache is the early cache
+	latencache *cache.Cache
+	latedenial bool
+
+	// Late caches for early refresh pods that declare a shorter lead, by lead
+	leadcaches map[time.Duration]*lateCaches
+	leadMu     sync.RWMutex
+
+	// Snapshot file to persist the caches across restarts
+	persistFile     string
+	persistInterval time.Duration
+	persistStop     chan struct{}
+	persistDone     chan struct{}
+
+	// Replication of early cache inserts to other replicas
+	replicator *replicator
+
+	// Admin API listener to inspect and purge the caches
+	adminAddr      string
+	adminTokenFile string // file with the token that admin requests must present
+	adminToken     []byte
+	adminServer    *http.Server
+	adminDone      chan struct{}
+
+	// Answer TSIG signed purge queries, only signed with purgeKeys if set
+	purgeQuery  bool
+	purgeKeys   []string
+	tsigSecrets map[string]string // TSIG secrets of the server, by key name
+
+	// URL to post answer changes to
+	changeWebhook string
+
+	// gRPC feed of early cache inserts
+	feed *feedServer
+
+	// Serve late items that expired at most lateFallback ago when upstream fails
+	lateFallback time.Duration
+
+	// Add extended DNS errors to stale and cached error responses, by cache type
+	edeSuccess bool
+	edeDenial  bool
+
+	// Hold changed answers back from the late cache until acknowledged, at most ackHold longer
+	ackHold  time.Duration
+	held     map[uint64]*heldAnswer
+	heldMu   sync.Mutex
+	heldStop chan struct{}
+	heldDone chan struct{}
+
+	// Prefetch workers, if the number of concurrent prefetches is limited
+	prefetcher *prefetcher
+
+	// Refresh popular names in the background
+	hotRefresh *hotRefresher
+
+	// Keep the names listed in a ConfigMap refreshed
+	warm *warmer
+
+	// Upstream queries in progress, by key
+	flights  map[uint64]*flight
+	flightMu sync.Mutex
 
 	k8sAPI *k8sAPI
+	// Treat all clients as early refresh clients until the k8sAPI has synced
+	earlyUntilSynced bool
 }
 
 func New() *Cache {
@@ -24,29 +100,148 @@ func New() *Cache {
 	return &Cache{
 		CacheBackend: cb,
 		latepcache: cache.New(defaultCap),
-		k8sAPI: &k8sAPI{},
+		leadcaches: make(map[time.Duration]*lateCaches),
+		zonettls: make(map[string]time.Duration),
+		held: make(map[uint64]*heldAnswer),
+		flights: make(map[uint64]*flight),
+		k8sAPI: newK8sAPI(),
 	}
 }
 
-// Copy item to c.latepcache if the conditions are right
-func (c *Cache) copyToLate(key uint64, i *item, now time.Time) {
-	if i.Rcode == dns.RcodeSuccess  {
-		ii, exists := c.latepcache.Get(key)
-		add := false
-		if exists {
+// Late positive and negative cache for clients with a certain lead
+type lateCaches struct {
+	pcache *cache.Cache
+	ncache *cache.Cache
+}
+
+// Copy item to the late caches if the conditions are right. Denials are only copied if
+// c.latedenial is set.
+func (c *Cache) copyToLate(key uint64, i *item, now time.Time, server string) {
+	if c.isLate(i) {
+		denial := i.denial()
+		typ := Success
+		if denial {
+			typ = Denial
+		}
+		extrattl := c.extraTTL(i.Name)
+		var added, evicted bool
+		if _, held := c.isHeld(key, now); !held {
+			added, evicted = addToLate(c.latepcache, c.latencache, key, i, now, extrattl, denial)
+		}
+		if added {
+			latePromotions.WithLabelValues(server, typ, c.zonesMetricLabel, c.viewMetricLabel).Inc()
+			// Early clients could get the item since it was stored, normal clients get it now
+			earlyLead.WithLabelValues(server, c.zonesMetricLabel, c.viewMetricLabel).Observe(now.Sub(i.stored).Seconds())
+			lateCacheSize.WithLabelValues(server, Success, c.zonesMetricLabel, c.viewMetricLabel).Set(float64(c.latepcache.Len()))
+			if c.latencache != nil {
+				lateCacheSize.WithLabelValues(server, Denial, c.zonesMetricLabel, c.viewMetricLabel).Set(float64(c.latencache.Len()))
+			}
+		}
+		if evicted {
+			lateEvictions.WithLabelValues(server, typ, c.zonesMetricLabel, c.viewMetricLabel).Inc()
+		}
+
+		c.leadMu.RLock()
+		for lead, lc := range c.leadcaches {
+			// Clients with at least this lead are served from the early cache for this name
+			if lead < extrattl {
+				if _, evicted := addToLate(lc.pcache, lc.ncache, key, i, now, extrattl-lead, denial); evicted {
+					lateEvictions.WithLabelValues(server, typ, c.zonesMetricLabel, c.viewMetricLabel).Inc()
+				}
+			}
+		}
+		c.leadMu.RUnlock()
+	}
+}
+
+// Return whether item is served to normal clients from a late cache. Denials are only if
+// c.latedenial is set, and names out of scope of early refreshes never are.
+func (c *Cache) isLate(i *item) bool {
+	if !c.earlyRefreshScope(i.Name) {
+		return false
+	}
+	denial := i.denial()
+	return (i.Rcode == dns.RcodeSuccess && !denial) || (denial && c.latedenial)
+}
+
+// Return whether qname is in scope of early refreshes. Names out of scope are cached as by the
+// cache plugin, without a late cache.
+func (c *Cache) earlyRefreshScope(qname string) bool {
+	if len(c.earlyZones) > 0 && plugin.Zones(c.earlyZones).Matches(qname) == "" {
+		return false
+	}
+	return len(c.excludeZones) == 0 || plugin.Zones(c.excludeZones).Matches(qname) == ""
+}
+
+// Get the early refresh duration for qname, from the longest matching zone, if any. It is 0 for
+// names out of scope of early refreshes.
+func (c *Cache) extraTTL(qname string) time.Duration {
+	if !c.earlyRefreshScope(qname) {
+		return 0
+	}
+	if len(c.ttlzones) > 0 {
+		if zone := plugin.Zones(c.ttlzones).Matches(qname); zone != "" {
+			return c.zonettls[zone]
+		}
+	}
+	return c.extrattl
+}
+
+// Add a copy of item to late positive cache pc or late negative cache nc, shifted by delay, if
+// neither has an unexpired item for key. The item for key in the other cache is removed, so that
+// it can't mask the new item when it becomes stale. nc is nil if denials are not cached late.
+// Returns whether the item was added, and whether another item was evicted to add it.
+func addToLate(pc, nc *cache.Cache, key uint64, i *item, now time.Time, delay time.Duration, denial bool) (bool, bool) {
+	for _, lc := range []*cache.Cache{pc, nc} {
+		if lc == nil {
+			continue
+		}
+		if ii, exists := lc.Get(key); exists {
 			li := ii.(*item)
-			if li.ttl(now) <= 0 {
-				add = true
+			if li.ttl(now) > 0 {
+				return false, false
 			}
-		} else {
-			add = true
 		}
-		if add {
-			newi := *i
-			newi.origTTL += uint32(c.extrattl.Seconds())
-			c.latepcache.Add(key, &newi)
+	}
+	newi := *i
+	newi.origTTL += uint32(delay.Seconds())
+	var evicted bool
+	if denial {
+		evicted = nc.Add(key, &newi)
+		pc.Remove(key)
+	} else {
+		evicted = pc.Add(key, &newi)
+		if nc != nil {
+			nc.Remove(key)
 		}
 	}
+	return true, evicted
+}
+
+// Get the late positive and negative cache for clients that get fresh answers lead before
+// normal clients. The negative cache is nil if denials are not cached late.
+func (c *Cache) lateCache(lead time.Duration) (*cache.Cache, *cache.Cache) {
+	if lead <= 0 {
+		return c.latepcache, c.latencache
+	}
+	c.leadMu.RLock()
+	lc, ok := c.leadcaches[lead]
+	c.leadMu.RUnlock()
+	if ok {
+		return lc.pcache, lc.ncache
+	}
+
+	c.leadMu.Lock()
+	defer c.leadMu.Unlock()
+	if lc, ok := c.leadcaches[lead]; ok {
+		return lc.pcache, lc.ncache
+	}
+	lc = &lateCaches{pcache: cache.New(c.pcap)}
+	if c.latedenial {
+		lc.ncache = cache.New(c.ncap)
+	}
+	c.leadcaches[lead] = lc
+	return lc.pcache, lc.ncache
 }
 
 // Get cache item for c.ncache or c.pcache (early cache). Only ncache item can be stale
@@ -73,29 +268,91 @@ func (c *Cache) getEarly(now time.Time, state request.Request, server string) *i
 	return nil
 }
 
+// Get cache item from c.latencache or c.latepcache, the late caches for normal clients
 func (c *Cache) getLate(now time.Time, state request.Request, server string) *item {
+	return c.getLateLead(now, state, server, 0)
+}
+
+// Get cache item from the late cache for clients that get fresh answers lead before normal clients
+func (c *Cache) getLateLead(now time.Time, state request.Request, server string, lead time.Duration) *item {
 	k := hash(state.Name(), state.QType(), state.Do(), state.Req.CheckingDisabled)
 	cacheRequests.WithLabelValues(server, c.zonesMetricLabel, c.viewMetricLabel).Inc()
 
-	if i, ok := c.latepcache.Get(k); ok {
+	pc, nc := c.lateCache(lead)
+	staleupto := c.staleUpTo - (c.extraTTL(state.Name()) - lead)
+	if nc != nil {
+		if i, ok := nc.Get(k); ok {
+			itm := i.(*item)
+			ttl := itm.ttl(now)
+			if ttl <= 0 && lead == 0 && itm.matches(state) {
+				if ext := c.extendHeld(nc, k, itm, now); ext != nil {
+					itm, ttl = ext, ext.ttl(now)
+				}
+			}
+			if itm.matches(state) && (ttl > 0 || (staleupto > 0 && -ttl < int(staleupto.Seconds()))) {
+				lateCacheHits.WithLabelValues(server, Denial, c.zonesMetricLabel, c.viewMetricLabel).Inc()
+				return itm
+			}
+		}
+	}
+	if i, ok := pc.Get(k); ok {
 		itm := i.(*item)
 		ttl := itm.ttl(now)
-		staleupto := c.staleUpTo - c.extrattl
+		if ttl <= 0 && lead == 0 && itm.matches(state) {
+			// Keep serving the previous answer while a new answer is held back
+			if ext := c.extendHeld(pc, k, itm, now); ext != nil {
+				itm, ttl = ext, ext.ttl(now)
+			}
+		}
 		if itm.matches(state) && (ttl > 0 || (staleupto > 0 && -ttl < int(staleupto.Seconds()))) {
-			cacheHits.WithLabelValues(server, Success, c.zonesMetricLabel, c.viewMetricLabel).Inc()
-			return i.(*item)
+			lateCacheHits.WithLabelValues(server, Success, c.zonesMetricLabel, c.viewMetricLabel).Inc()
+			return itm
 		}
 	}
 	return nil
 }
 
-func (c *Cache) NeedEarlyRefresh(state request.Request) bool {
-	earlyips := c.k8sAPI.getEarlyRefreshIPs()
-	me := state.IP()
-	for _, ip := range earlyips {
-			if ip == me {
-				return true
+// Get an expired item from the late cache for clients with lead, if it expired at most
+// c.lateFallback ago. It is served instead of upstream failures.
+func (c *Cache) getLateFallback(now time.Time, state request.Request, lead time.Duration) *item {
+	if c.lateFallback <= 0 {
+		return nil
+	}
+	k := hash(state.Name(), state.QType(), state.Do(), state.Req.CheckingDisabled)
+	pc, nc := c.lateCache(lead)
+	for _, lc := range []*cache.Cache{nc, pc} {
+		if lc == nil {
+			continue
+		}
+		if i, ok := lc.Get(k); ok {
+			itm := i.(*item)
+			if itm.matches(state) && -itm.ttl(now) < int(c.lateFallback.Seconds()) {
+				return itm
 			}
+		}
+	}
+	return nil
+}
+
+func (c *Cache) NeedEarlyRefresh(state request.Request) bool {
+	_, early := c.earlyRefreshLead(state)
+	return early
+}
+
+// Return whether the client of state should receive early refreshes, and if so, how long before
+// normal clients it gets fresh answers. This is the early refresh duration of the queried name,
+// unless the pod declares a shorter lead.
+func (c *Cache) earlyRefreshLead(state request.Request) (time.Duration, bool) {
+	extrattl := c.extraTTL(state.Name())
+	if c.earlyUntilSynced && !c.k8sAPI.hasSynced() {
+		return extrattl, true
+	}
+	pod := c.k8sAPI.earlyRefreshPod(state.IP())
+	if pod == nil {
+		return 0, false
+	}
+	if lead, ok := podLead(pod); ok && lead < extrattl {
+		return lead, true
 	}
-	return false
+	return extrattl, true
 }
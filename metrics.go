@@ -57,6 +57,13 @@ var (
 		Name:      "served_stale_total",
 		Help:      "The number of requests served from stale cache entries.",
 	}, []string{"server", "zones", "view"})
+	// lateFallbacks is the number of requests served from expired late cache entries on upstream failure.
+	lateFallbacks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "cache",
+		Name:      "late_fallbacks_total",
+		Help:      "The number of requests served from expired late cache entries because upstream failed.",
+	}, []string{"server", "zones", "view"})
 	// evictions is the counter of cache evictions.
 	evictions = promauto.NewCounterVec(prometheus.CounterOpts{
 		Namespace: plugin.Namespace,
@@ -64,4 +71,146 @@ var (
 		Name:      "evictions_total",
 		Help:      "The count of cache evictions.",
 	}, []string{"server", "type", "zones", "view"})
+	// lateCacheSize is total elements in the late cache for normal clients by cache type.
+	lateCacheSize = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "cache",
+		Name:      "late_entries",
+		Help:      "The number of elements in the late cache.",
+	}, []string{"server", "type", "zones", "view"})
+	// lateCacheHits is counter of late cache hits by cache type.
+	lateCacheHits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "cache",
+		Name:      "late_hits_total",
+		Help:      "The count of late cache hits.",
+	}, []string{"server", "type", "zones", "view"})
+	// lateEvictions is the counter of late cache evictions.
+	lateEvictions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "cache",
+		Name:      "late_evictions_total",
+		Help:      "The count of late cache evictions.",
+	}, []string{"server", "type", "zones", "view"})
+	// latePromotions is the counter of items copied from the early to the late cache.
+	latePromotions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "cache",
+		Name:      "late_promotions_total",
+		Help:      "The count of items copied from the early cache to the late cache.",
+	}, []string{"server", "type", "zones", "view"})
+	// earlyLead is the time early refresh clients could get an item before normal clients.
+	earlyLead = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "cache",
+		Name:      "early_lead_seconds",
+		Buckets:   []float64{0, 1, 2, 5, 10, 15, 30, 60, 120},
+		Help:      "Histogram of the time early refresh clients could get a new item before normal clients.",
+	}, []string{"server", "zones", "view"})
+	// clientRequests is a counter of requests by early refresh and normal clients.
+	clientRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "cache",
+		Name:      "client_requests_total",
+		Help:      "The count of requests by early refresh clients and normal clients.",
+	}, []string{"server", "client", "zones", "view"})
+	// answerChanges is the counter of new answers that differ from the late cache.
+	answerChanges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "cache",
+		Name:      "answer_changes_total",
+		Help:      "The count of new answers in the early cache that differ from the answer in the late cache.",
+	}, []string{"server", "zones", "view"})
+	// feedDrops is the counter of feed updates not sent to slow subscribers.
+	feedDrops = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "cache",
+		Name:      "feed_drops_total",
+		Help:      "The count of feed updates dropped because a subscriber did not keep up.",
+	})
+	// ackTimeouts is the counter of new answers released without acknowledgement.
+	ackTimeouts = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "cache",
+		Name:      "ack_timeouts_total",
+		Help:      "The count of new answers released to the late cache because they were not acknowledged in time.",
+	})
+	// earlyRefreshIPs is the number of known early refresh pod IPs.
+	earlyRefreshIPs = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "cache",
+		Name:      "early_refresh_ips",
+		Help:      "The number of known early refresh pod IPs.",
+	})
+	// purgeRefused is the counter of refused purge queries.
+	purgeRefused = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "cache",
+		Name:      "purge_refused_total",
+		Help:      "The count of purge queries refused because they were not signed with a valid TSIG key.",
+	}, []string{"server", "zones", "view"})
+	// coalescedRequests is the counter of upstream queries saved by waiting for a query in progress.
+	coalescedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "cache",
+		Name:      "coalesced_requests_total",
+		Help:      "The count of requests and prefetches that waited for an upstream query in progress for the same name.",
+	}, []string{"server", "zones", "view"})
+	// prefetchQueueLength is the number of queued prefetches.
+	prefetchQueueLength = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "cache",
+		Name:      "prefetch_queue_length",
+		Help:      "The number of prefetches waiting for a prefetch worker.",
+	})
+	// prefetchDrops is the counter of prefetches dropped because the queue was full.
+	prefetchDrops = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "cache",
+		Name:      "prefetch_drops_total",
+		Help:      "The count of prefetches dropped because the prefetch queue was full.",
+	}, []string{"server", "zones", "view"})
+	// prefetchQueueLatency is the time prefetches wait for a prefetch worker.
+	prefetchQueueLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "cache",
+		Name:      "prefetch_queue_latency_seconds",
+		Buckets:   plugin.TimeBuckets,
+		Help:      "Histogram of the time prefetches waited in the queue for a prefetch worker.",
+	}, []string{"server", "zones", "view"})
+	// hotRefreshes is the counter of background refreshes of popular names.
+	hotRefreshes = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "cache",
+		Name:      "hot_refreshes_total",
+		Help:      "The count of popular names refreshed in the background before they expired.",
+	})
+	// warmNames is the number of names kept warm.
+	warmNames = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "cache",
+		Name:      "keep_warm_names",
+		Help:      "The number of names and query types listed in the keep_warm ConfigMap.",
+	})
+	// warmRefreshes is the counter of refreshes of names kept warm.
+	warmRefreshes = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "cache",
+		Name:      "keep_warm_refreshes_total",
+		Help:      "The count of refreshes of names listed in the keep_warm ConfigMap.",
+	})
+	// rejectedPods is the counter of selected pods that are not allowed to get early refreshes.
+	rejectedPods = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "cache",
+		Name:      "early_refresh_rejected_pods_total",
+		Help:      "The count of pods selected for early refreshes that were rejected because of their service account.",
+	})
+	// earlyRefreshIPCollisions is the number of early refresh pod IPs also used by other pods.
+	earlyRefreshIPCollisions = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "cache",
+		Name:      "early_refresh_ip_collisions",
+		Help:      "The number of early refresh pod IPs that are also used by other running pods.",
+	})
 )
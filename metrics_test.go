@@ -0,0 +1,59 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLateMetrics(t *testing.T) {
+	c := newTestK8sCache(true)
+	c.Next = ttlBackend(10)
+	ctx := context.TODO()
+	start := time.Now()
+
+	counters := func() [5]float64 {
+		return [5]float64{
+			testutil.ToFloat64(clientRequests.WithLabelValues("", "early", c.zonesMetricLabel, c.viewMetricLabel)),
+			testutil.ToFloat64(clientRequests.WithLabelValues("", "normal", c.zonesMetricLabel, c.viewMetricLabel)),
+			testutil.ToFloat64(latePromotions.WithLabelValues("", Success, c.zonesMetricLabel, c.viewMetricLabel)),
+			testutil.ToFloat64(lateCacheHits.WithLabelValues("", Success, c.zonesMetricLabel, c.viewMetricLabel)),
+			testutil.ToFloat64(cacheHits.WithLabelValues("", Success, c.zonesMetricLabel, c.viewMetricLabel)),
+		}
+	}
+	tests := []struct {
+		futureSeconds int
+		w             dns.ResponseWriter
+		delta         [5]float64 // early requests, normal requests, promotions, late hits, early hits
+	}{
+		{0, &test.ResponseWriter{}, [5]float64{1, 0, 1, 0, 0}},   // Cached, and promoted to the empty late cache
+		{1, &test.ResponseWriter6{}, [5]float64{0, 1, 0, 1, 0}},  // Late cache hit
+		{2, &test.ResponseWriter{}, [5]float64{1, 0, 0, 0, 1}},   // Early cache hit
+		{12, &test.ResponseWriter{}, [5]float64{1, 0, 0, 0, 0}},  // Refreshed, not promoted while the late item is valid
+		{16, &test.ResponseWriter6{}, [5]float64{0, 1, 1, 0, 1}}, // Late item expired, promoted
+	}
+	for i, tt := range tests {
+		c.now = func() time.Time { return start.Add(time.Duration(tt.futureSeconds) * time.Second) }
+		before := counters()
+		req := new(dns.Msg)
+		req.SetQuestion("example.org.", dns.TypeA)
+		c.ServeDNS(ctx, dnstest.NewRecorder(tt.w), req)
+		after := counters()
+		var delta [5]float64
+		for j := range after {
+			delta[j] = after[j] - before[j]
+		}
+		if delta != tt.delta {
+			t.Errorf("Test %d: expected counter deltas %v, got %v", i, tt.delta, delta)
+		}
+	}
+	if n := testutil.ToFloat64(lateCacheSize.WithLabelValues("", Success, c.zonesMetricLabel, c.viewMetricLabel)); n != 1 {
+		t.Errorf("Expected 1 late cache entry, got %v", n)
+	}
+}
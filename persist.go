@@ -0,0 +1,240 @@
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/cache"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	snapshotVersion        = 1
+	defaultPersistInterval = 1 * time.Minute
+)
+
+// snapshot is the on-disk format of the cache contents.
+type snapshot struct {
+	Version int             `json:"version"`
+	Entries []snapshotEntry `json:"entries"`
+}
+
+// snapshotEntry is a single cache item in a snapshot. The resource records are stored as a
+// message in wire format.
+type snapshotEntry struct {
+	Type     string        `json:"type"` // Success or Denial
+	Late     bool          `json:"late,omitempty"`
+	Lead     time.Duration `json:"lead,omitempty"`
+	Key      uint64        `json:"key"`
+	Msg      []byte        `json:"msg"`
+	Wildcard string        `json:"wildcard,omitempty"`
+	OrigTTL  uint32        `json:"origTTL"`
+	Stored   time.Time     `json:"stored"`
+}
+
+// newSnapshotEntry returns an entry for item i with key in the early cache of type typ.
+func newSnapshotEntry(key uint64, i *item, typ string) (snapshotEntry, error) {
+	msg, err := i.pack()
+	if err != nil {
+		return snapshotEntry{}, err
+	}
+	return snapshotEntry{
+		Type:     typ,
+		Key:      key,
+		Msg:      msg,
+		Wildcard: i.wildcard,
+		OrigTTL:  i.origTTL,
+		Stored:   i.stored,
+	}, nil
+}
+
+// item returns the cache item stored in e.
+func (e snapshotEntry) item() (*item, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(e.Msg); err != nil {
+		return nil, err
+	}
+	i := newItem(m, e.Stored, time.Duration(e.OrigTTL)*time.Second)
+	i.wildcard = e.Wildcard
+	return i, nil
+}
+
+// snapshotCache is one of the caches that are persisted, with its placement.
+type snapshotCache struct {
+	cache *cache.Cache
+	typ   string
+	late  bool
+	lead  time.Duration
+}
+
+func (c *Cache) snapshotCaches() []snapshotCache {
+	caches := []snapshotCache{
+		{cache: c.pcache, typ: Success},
+		{cache: c.ncache, typ: Denial},
+		{cache: c.latepcache, typ: Success, late: true},
+	}
+	if c.latencache != nil {
+		caches = append(caches, snapshotCache{cache: c.latencache, typ: Denial, late: true})
+	}
+	c.leadMu.RLock()
+	defer c.leadMu.RUnlock()
+	for lead, lc := range c.leadcaches {
+		caches = append(caches, snapshotCache{cache: lc.pcache, typ: Success, late: true, lead: lead})
+		if lc.ncache != nil {
+			caches = append(caches, snapshotCache{cache: lc.ncache, typ: Denial, late: true, lead: lead})
+		}
+	}
+	return caches
+}
+
+// walkItems returns the keys and items in ca matching match. The cache is locked while walking,
+// so the items are returned for processing instead.
+func walkItems(ca *cache.Cache, match func(*item) bool) ([]uint64, []*item) {
+	keys := []uint64{}
+	items := []*item{}
+	ca.Walk(func(m map[uint64]interface{}, key uint64) bool {
+		if i, ok := m[key].(*item); ok && match(i) {
+			keys = append(keys, key)
+			items = append(items, i)
+		}
+		return true
+	})
+	return keys, items
+}
+
+// snapshot returns all unexpired items in the caches.
+func (c *Cache) snapshot(now time.Time) *snapshot {
+	s := &snapshot{Version: snapshotVersion}
+	for _, sc := range c.snapshotCaches() {
+		keys, items := walkItems(sc.cache, func(i *item) bool { return i.ttl(now) > 0 })
+		for j, i := range items {
+			e, err := newSnapshotEntry(keys[j], i, sc.typ)
+			if err != nil {
+				log.Warningf("Not persisting cache item %s: %s", i.Name, err)
+				continue
+			}
+			e.Late, e.Lead = sc.late, sc.lead
+			s.Entries = append(s.Entries, e)
+		}
+	}
+	return s
+}
+
+// restore adds the unexpired entries of s to the caches, and returns the number of restored entries.
+func (c *Cache) restore(s *snapshot, now time.Time) int {
+	n := 0
+	for _, e := range s.Entries {
+		i, err := e.item()
+		if err != nil {
+			log.Warningf("Not restoring cache entry: %s", err)
+			continue
+		}
+		if i.ttl(now) <= 0 {
+			continue
+		}
+
+		var dst *cache.Cache
+		switch {
+		case !e.Late && e.Type == Success:
+			dst = c.pcache
+		case !e.Late && e.Type == Denial:
+			dst = c.ncache
+		case e.Type == Success:
+			dst, _ = c.lateCache(e.Lead)
+		case e.Type == Denial:
+			_, dst = c.lateCache(e.Lead)
+		}
+		if dst == nil {
+			continue
+		}
+		dst.Add(e.Key, i)
+		n++
+	}
+	return n
+}
+
+// saveSnapshot writes the cache contents to c.persistFile. The file is replaced atomically.
+func (c *Cache) saveSnapshot() error {
+	s := c.snapshot(c.now())
+	f, err := os.CreateTemp(filepath.Dir(c.persistFile), filepath.Base(c.persistFile)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := json.NewEncoder(f).Encode(s); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), c.persistFile)
+}
+
+// loadSnapshot restores the cache contents from c.persistFile, if it exists.
+func (c *Cache) loadSnapshot() error {
+	f, err := os.Open(c.persistFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s := new(snapshot)
+	if err := json.NewDecoder(f).Decode(s); err != nil {
+		return err
+	}
+	if s.Version != snapshotVersion {
+		log.Warningf("Ignoring cache snapshot %s with unsupported version %d", c.persistFile, s.Version)
+		return nil
+	}
+	n := c.restore(s, c.now())
+	log.Infof("Restored %d cache entries from %s", n, c.persistFile)
+	return nil
+}
+
+// startPersist starts saving snapshots every c.persistInterval.
+func (c *Cache) startPersist() {
+	c.persistStop = make(chan struct{})
+	c.persistDone = make(chan struct{})
+	go c.persist()
+}
+
+// stopPersist stops saving snapshots after saving a final one, if they are being saved.
+func (c *Cache) stopPersist() {
+	if c.persistStop == nil {
+		return
+	}
+	close(c.persistStop)
+	<-c.persistDone
+	c.persistStop = nil
+}
+
+// persist saves a snapshot every c.persistInterval until c.persistStop is closed, and once more
+// when stopped.
+func (c *Cache) persist() {
+	defer close(c.persistDone)
+	ticker := time.NewTicker(c.persistInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.saveSnapshot(); err != nil {
+				log.Errorf("Failed to persist cache to %s: %s", c.persistFile, err)
+			}
+		case <-c.persistStop:
+			if err := c.saveSnapshot(); err != nil {
+				log.Errorf("Failed to persist cache to %s: %s", c.persistFile, err)
+			}
+			return
+		}
+	}
+}
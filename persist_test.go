@@ -0,0 +1,110 @@
+package cache
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/cache"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+func TestPersist(t *testing.T) {
+	c := newTestK8sCache(true)
+	c.latedenial = true
+	c.latencache = cache.New(defaultCap)
+	c.persistFile = filepath.Join(t.TempDir(), "cache.json")
+	ctx := context.TODO()
+
+	// Cache a positive answer with 60s TTL, a denial with 30s TTL and a positive answer with 10s TTL
+	for _, q := range []struct {
+		qname   string
+		backend plugin.Handler
+	}{
+		{"example.org.", ttlBackend(60)},
+		{"nx.example.org.", nxDomainBackend(30)},
+		{"short.example.org.", ttlBackend(10)},
+	} {
+		c.Next = q.backend
+		req := new(dns.Msg)
+		req.SetQuestion(q.qname, dns.TypeA)
+		c.ServeDNS(ctx, dnstest.NewRecorder(&test.ResponseWriter6{}), req)
+	}
+	if err := c.saveSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Restart 20s later, the 10s early item should be discarded
+	t0 := time.Now()
+	c2 := newTestK8sCache(true)
+	c2.latedenial = true
+	c2.latencache = cache.New(defaultCap)
+	c2.persistFile = c.persistFile
+	c2.now = func() time.Time { return t0.Add(20 * time.Second) }
+	if err := c2.loadSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, c2.pcache.Len(); want != got {
+		t.Errorf("Expected %d restored early positive items, got %d", want, got)
+	}
+	if want, got := 1, c2.ncache.Len(); want != got {
+		t.Errorf("Expected %d restored early negative items, got %d", want, got)
+	}
+	if want, got := 1, c2.latencache.Len(); want != got {
+		t.Errorf("Expected %d restored late negative items, got %d", want, got)
+	}
+	// The late item of short.example.org. expired at 15s
+	if want, got := 1, c2.latepcache.Len(); want != got {
+		t.Errorf("Expected %d restored late positive items, got %d", want, got)
+	}
+
+	// Restored items are served without querying upstream, with the remaining TTL
+	c2.Next = plugin.HandlerFunc(func(context.Context, dns.ResponseWriter, *dns.Msg) (int, error) {
+		return 255, nil // Below, a 255 means we tried querying upstream.
+	})
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter6{})
+	if ret, _ := c2.ServeDNS(ctx, rec, req); ret == 255 {
+		t.Fatalf("Expected restored item to be served from the cache")
+	}
+	if ttl := rec.Msg.Answer[0].Header().Ttl; ttl < 44 || ttl > 45 {
+		t.Errorf("Expected remaining late TTL of 45s, got %d", ttl)
+	}
+}
+
+func TestPersistMissingFile(t *testing.T) {
+	c := newTestK8sCache(false)
+	c.persistFile = filepath.Join(t.TempDir(), "missing.json")
+	if err := c.loadSnapshot(); err != nil {
+		t.Errorf("Expected no error for missing snapshot file, got %s", err)
+	}
+}
+
+func TestPersistStop(t *testing.T) {
+	c := newTestK8sCache(false)
+	c.persistFile = filepath.Join(t.TempDir(), "cache.json")
+	c.persistInterval = time.Hour
+	c.startPersist()
+	c.Next = ttlBackend(60)
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	c.ServeDNS(context.TODO(), dnstest.NewRecorder(&test.ResponseWriter6{}), req)
+
+	// Stopping, e.g. on a reload, saves the inserts since the last snapshot
+	c.stopPersist()
+	c.stopPersist()
+	c2 := newTestK8sCache(false)
+	c2.persistFile = c.persistFile
+	if err := c2.loadSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if c2.pcache.Len() != 1 {
+		t.Errorf("Expected the item inserted since the last snapshot to be restored, got %d items", c2.pcache.Len())
+	}
+}
@@ -0,0 +1,152 @@
+package cache
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/request"
+)
+
+const defaultPrefetchQueueLen = 1000
+
+// prefetchTask is a queued prefetch of item i.
+type prefetchTask struct {
+	ctx    context.Context
+	state  request.Request
+	cw     *ResponseWriter
+	i      *item
+	now    time.Time
+	key    uint64
+	queued time.Time
+}
+
+// prefetcher runs prefetches on a fixed number of workers. Prefetches triggered by early refresh
+// clients are run before others, because they keep the late cache for normal clients filled.
+type prefetcher struct {
+	cache    *Cache
+	workers  int
+	queueLen int
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	early   []*prefetchTask
+	normal  []*prefetchTask
+	queued  map[uint64]struct{}
+	stopped bool
+	wg      sync.WaitGroup
+}
+
+func newPrefetcher(c *Cache, workers, queueLen int) *prefetcher {
+	p := &prefetcher{
+		cache:    c,
+		workers:  workers,
+		queueLen: queueLen,
+		queued:   make(map[uint64]struct{}),
+	}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// start starts the workers.
+func (p *prefetcher) start() {
+	p.mu.Lock()
+	p.stopped = false
+	p.mu.Unlock()
+	for n := 0; n < p.workers; n++ {
+		p.wg.Add(1)
+		go p.run()
+	}
+}
+
+// stop stops the workers after their current prefetch, and discards the queued prefetches.
+func (p *prefetcher) stop() {
+	p.mu.Lock()
+	p.stopped = true
+	p.early, p.normal = nil, nil
+	p.queued = make(map[uint64]struct{})
+	p.mu.Unlock()
+	p.cond.Broadcast()
+	p.wg.Wait()
+	prefetchQueueLength.Set(0)
+}
+
+// add queues t, unless a prefetch of the same key is already queued. If the queue is full, the
+// oldest prefetch of a normal client is dropped to make room for a prefetch of an early refresh
+// client; other prefetches are dropped.
+func (p *prefetcher) add(t *prefetchTask, early bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopped {
+		return
+	}
+	if _, ok := p.queued[t.key]; ok {
+		coalescedRequests.WithLabelValues(t.cw.server, p.cache.zonesMetricLabel, p.cache.viewMetricLabel).Inc()
+		return
+	}
+	if len(p.early)+len(p.normal) >= p.queueLen {
+		if !early || len(p.normal) == 0 {
+			prefetchDrops.WithLabelValues(t.cw.server, p.cache.zonesMetricLabel, p.cache.viewMetricLabel).Inc()
+			return
+		}
+		d := p.normal[0]
+		p.normal = p.normal[1:]
+		delete(p.queued, d.key)
+		prefetchDrops.WithLabelValues(d.cw.server, p.cache.zonesMetricLabel, p.cache.viewMetricLabel).Inc()
+	}
+	if early {
+		p.early = append(p.early, t)
+	} else {
+		p.normal = append(p.normal, t)
+	}
+	p.queued[t.key] = struct{}{}
+	prefetchQueueLength.Set(float64(len(p.early) + len(p.normal)))
+	p.cond.Signal()
+}
+
+// next returns the next prefetch to run, or nil if p is stopped.
+func (p *prefetcher) next() *prefetchTask {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for !p.stopped && len(p.early) == 0 && len(p.normal) == 0 {
+		p.cond.Wait()
+	}
+	if p.stopped {
+		return nil
+	}
+	var t *prefetchTask
+	if len(p.early) > 0 {
+		t, p.early = p.early[0], p.early[1:]
+	} else {
+		t, p.normal = p.normal[0], p.normal[1:]
+	}
+	delete(p.queued, t.key)
+	prefetchQueueLength.Set(float64(len(p.early) + len(p.normal)))
+	return t
+}
+
+func (p *prefetcher) run() {
+	defer p.wg.Done()
+	for t := p.next(); t != nil; t = p.next() {
+		prefetchQueueLatency.WithLabelValues(t.cw.server, p.cache.zonesMetricLabel, p.cache.viewMetricLabel).Observe(time.Since(t.queued).Seconds())
+		p.cache.doPrefetch(t.ctx, t.state, t.cw, t.i, t.now)
+	}
+}
+
+// schedulePrefetch prefetches item i for state, on the prefetch workers if configured, and
+// otherwise in a new goroutine. early is set if an early refresh client triggered the prefetch.
+func (c *Cache) schedulePrefetch(ctx context.Context, state request.Request, cw *ResponseWriter, i *item, now time.Time, early bool) {
+	if c.prefetcher == nil {
+		go c.doPrefetch(ctx, state, cw, i, now)
+		return
+	}
+	c.prefetcher.add(&prefetchTask{
+		ctx:    ctx,
+		state:  state,
+		cw:     cw,
+		i:      i,
+		now:    now,
+		key:    hash(state.Name(), state.QType(), state.Do(), state.Req.CheckingDisabled),
+		queued: time.Now(),
+	}, early)
+}
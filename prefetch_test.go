@@ -9,8 +9,10 @@ import (
 	"github.com/coredns/coredns/plugin"
 	"github.com/coredns/coredns/plugin/pkg/dnstest"
 	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
 
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestPrefetch(t *testing.T) {
@@ -200,6 +202,66 @@ func TestPrefetch(t *testing.T) {
 	}
 }
 
+func TestPrefetchQueue(t *testing.T) {
+	c := newTestK8sCache(true)
+	p := newPrefetcher(c, 1, 2)
+	drops := testutil.ToFloat64(prefetchDrops.WithLabelValues("", c.zonesMetricLabel, c.viewMetricLabel))
+	coalesced := testutil.ToFloat64(coalescedRequests.WithLabelValues("", c.zonesMetricLabel, c.viewMetricLabel))
+
+	for _, a := range []struct {
+		key   uint64
+		early bool
+	}{
+		{1, false},
+		{1, false}, // Already queued
+		{2, false},
+		{3, true},  // Queue full, drops 1
+		{4, false}, // Queue full, dropped
+	} {
+		p.add(&prefetchTask{key: a.key, cw: &ResponseWriter{}, queued: time.Now()}, a.early)
+	}
+
+	if n := testutil.ToFloat64(prefetchDrops.WithLabelValues("", c.zonesMetricLabel, c.viewMetricLabel)) - drops; n != 2 {
+		t.Errorf("Expected 2 dropped prefetches, got %v", n)
+	}
+	if n := testutil.ToFloat64(coalescedRequests.WithLabelValues("", c.zonesMetricLabel, c.viewMetricLabel)) - coalesced; n != 1 {
+		t.Errorf("Expected 1 coalesced prefetch, got %v", n)
+	}
+	if n := testutil.ToFloat64(prefetchQueueLength); n != 2 {
+		t.Errorf("Expected queue length 2, got %v", n)
+	}
+	for _, key := range []uint64{3, 2} {
+		if task := p.next(); task.key != key {
+			t.Errorf("Expected prefetch of key %d, got %d", key, task.key)
+		}
+	}
+}
+
+func TestPrefetchWorkers(t *testing.T) {
+	c := newTestK8sCache(true)
+	c.prefetch = 1
+	c.percentage = 50
+	c.duration = time.Minute
+	c.prefetcher = newPrefetcher(c, 2, 10)
+	c.prefetcher.start()
+	defer c.prefetcher.stop()
+	c.Next = ttlBackend(10)
+
+	ctx := context.TODO()
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	c.ServeDNS(ctx, dnstest.NewRecorder(&test.ResponseWriter{}), req.Copy())
+
+	// Close to expiry, the early refresh pod triggers a prefetch on a worker
+	c.Next = ttlBackend(20)
+	c.now = func() time.Time { return time.Now().Add(8 * time.Second) }
+	c.ServeDNS(ctx, dnstest.NewRecorder(&test.ResponseWriter{}), req.Copy())
+	waitFor(t, "prefetched item", func() bool {
+		i := c.exists(request.Request{W: &test.ResponseWriter{}, Req: req})
+		return i != nil && i.origTTL == 20
+	})
+}
+
 type verification struct {
 	after  time.Duration
 	answer string
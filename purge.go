@@ -0,0 +1,93 @@
+package cache
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// purgePrefix is the prefix of purge queries. A query for _purge.NAME purges NAME, and a query
+// for _purge.*.ZONE purges all names in ZONE.
+const purgePrefix = "_purge."
+
+// isPurge returns true if state is a purge query and purge queries are enabled.
+func (c *Cache) isPurge(state request.Request) bool {
+	return c.purgeQuery && strings.HasPrefix(state.Name(), purgePrefix)
+}
+
+// servePurge purges the names selected by the purge query r from the caches and replies with the
+// number of removed items in a TXT record. The query must be signed with a valid TSIG key of the
+// server, which must be one of c.purgeKeys if set.
+func (c *Cache) servePurge(w dns.ResponseWriter, r *dns.Msg, state request.Request, server string) (int, error) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+
+	t := r.IsTsig()
+	if t == nil || !c.tsigValid(w, r, t, server) || !c.purgeKeyAllowed(t.Hdr.Name) {
+		purgeRefused.WithLabelValues(server, c.zonesMetricLabel, c.viewMetricLabel).Inc()
+		log.Warningf("Refused unauthenticated purge query for %s from %s", state.Name(), state.IP())
+		m.Rcode = dns.RcodeRefused
+		w.WriteMsg(m)
+		return dns.RcodeRefused, nil
+	}
+
+	name := strings.TrimPrefix(state.Name(), purgePrefix)
+	var match func(*item) bool
+	if zone := strings.TrimPrefix(name, "*."); zone != name {
+		match, _ = nameMatch("", zone)
+	} else {
+		match, _ = nameMatch(name, "")
+	}
+	n := c.purge(match)
+	log.Infof("Purged %d cache items for %s with key %s", n, name, t.Hdr.Name)
+
+	m.Answer = []dns.RR{&dns.TXT{
+		Hdr: dns.RR_Header{Name: state.QName(), Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+		Txt: []string{strconv.Itoa(n)},
+	}}
+	m.SetTsig(t.Hdr.Name, t.Algorithm, t.Fudge, time.Now().Unix())
+	w.WriteMsg(m)
+	return dns.RcodeSuccess, nil
+}
+
+// tsigValid returns true if the TSIG signature t of r, received by server, is valid. Servers of
+// the dns transport verify the signature of the received message with the TSIG secrets, and report
+// the result in the TsigStatus of w. The others, e.g. DoT, DoH and gRPC, don't verify it and have a
+// nil TsigStatus, so there the signature is verified with c.tsigSecrets against r packed again.
+// As the original message isn't available, that fails if the client packed it differently, e.g.
+// with name compression.
+func (c *Cache) tsigValid(w dns.ResponseWriter, r *dns.Msg, t *dns.TSIG, server string) bool {
+	if w.TsigStatus() != nil {
+		return false
+	}
+	secret, ok := c.tsigSecrets[plugin.Name(t.Hdr.Name).Normalize()]
+	if !ok {
+		return false
+	}
+	if strings.HasPrefix(server, transport.DNS+"://") {
+		return true
+	}
+	buf, err := r.Pack()
+	if err != nil {
+		return false
+	}
+	return dns.TsigVerify(buf, secret, "", false) == nil
+}
+
+func (c *Cache) purgeKeyAllowed(key string) bool {
+	if len(c.purgeKeys) == 0 {
+		return true
+	}
+	for _, k := range c.purgeKeys {
+		if strings.EqualFold(k, key) {
+			return true
+		}
+	}
+	return false
+}
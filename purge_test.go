@@ -0,0 +1,152 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// tsigFailWriter is a ResponseWriter for requests with an invalid TSIG signature.
+type tsigFailWriter struct {
+	test.ResponseWriter
+}
+
+func (w *tsigFailWriter) TsigStatus() error { return dns.ErrSig }
+
+// purgeQuery returns a purge query for qname, signed with key and secret if key is set.
+func purgeQuery(t *testing.T, qname, key, secret string) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion(qname, dns.TypeTXT)
+	if key == "" {
+		return req
+	}
+	req.SetTsig(key, dns.HmacSHA256, 300, time.Now().Unix())
+	buf, _, err := dns.TsigGenerate(req, secret, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := new(dns.Msg)
+	if err := signed.Unpack(buf); err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestPurgeQuery(t *testing.T) {
+	c, _ := newTestAdmin(t)
+	c.purgeQuery = true
+	c.purgeKeys = []string{"purge.key."}
+	c.tsigSecrets = map[string]string{"purge.key.": "c2VjcmV0", "other.key.": "b3RoZXI="}
+	ctx := context.TODO()
+
+	// test.ResponseWriter has a nil TsigStatus, as the server writers of DoH, DoQ and gRPC
+	tests := []struct {
+		qname   string
+		key     string
+		secret  string
+		w       dns.ResponseWriter
+		rcode   int
+		removed string
+	}{
+		{"_purge.www.example.org.", "", "", &test.ResponseWriter{}, dns.RcodeRefused, ""},
+		{"_purge.www.example.org.", "purge.key.", "c2VjcmV0", &tsigFailWriter{}, dns.RcodeRefused, ""},
+		{"_purge.www.example.org.", "purge.key.", "Zm9yZ2Vk", &test.ResponseWriter{}, dns.RcodeRefused, ""}, // Forged MAC
+		{"_purge.www.example.org.", "unknown.key.", "c2VjcmV0", &test.ResponseWriter{}, dns.RcodeRefused, ""},
+		{"_purge.www.example.org.", "other.key.", "b3RoZXI=", &test.ResponseWriter{}, dns.RcodeRefused, ""},
+		{"_purge.www.example.org.", "purge.key.", "c2VjcmV0", &test.ResponseWriter{}, dns.RcodeSuccess, "2"},
+		{"_purge.www.example.org.", "purge.key.", "c2VjcmV0", &test.ResponseWriter{}, dns.RcodeSuccess, "0"},
+		{"_purge.*.example.org.", "purge.key.", "c2VjcmV0", &test.ResponseWriter{}, dns.RcodeSuccess, "3"},
+		{"_purge.*.", "purge.key.", "c2VjcmV0", &test.ResponseWriter{}, dns.RcodeSuccess, "2"},
+	}
+	refused := testutil.ToFloat64(purgeRefused.WithLabelValues("", c.zonesMetricLabel, c.viewMetricLabel))
+	for i, tt := range tests {
+		rec := dnstest.NewRecorder(tt.w)
+		c.ServeDNS(ctx, rec, purgeQuery(t, tt.qname, tt.key, tt.secret))
+
+		if rec.Msg.Rcode != tt.rcode {
+			t.Errorf("Test %d: expected rcode %s, got %s", i, dns.RcodeToString[tt.rcode], dns.RcodeToString[rec.Msg.Rcode])
+			continue
+		}
+		if tt.rcode != dns.RcodeSuccess {
+			refused++
+			continue
+		}
+		if len(rec.Msg.Answer) != 1 || rec.Msg.Answer[0].(*dns.TXT).Txt[0] != tt.removed {
+			t.Errorf("Test %d: expected %s removed items, got %v", i, tt.removed, rec.Msg.Answer)
+		}
+		if rec.Msg.IsTsig() == nil {
+			t.Errorf("Test %d: expected signed reply", i)
+		}
+	}
+	if got := testutil.ToFloat64(purgeRefused.WithLabelValues("", c.zonesMetricLabel, c.viewMetricLabel)); got != refused {
+		t.Errorf("Expected %v refused purge queries, got %v", refused, got)
+	}
+	if n := c.pcache.Len() + c.ncache.Len() + c.latepcache.Len(); n != 0 {
+		t.Errorf("Expected all caches to be purged, %d items left", n)
+	}
+}
+
+func TestPurgeQueryCompressed(t *testing.T) {
+	c, _ := newTestAdmin(t)
+	c.purgeQuery = true
+	c.tsigSecrets = map[string]string{"purge.example.org.": "c2VjcmV0"}
+
+	// Sign a query with name compression, as nsupdate does. The name of the additional record is
+	// compressed.
+	req := new(dns.Msg)
+	req.SetQuestion("_purge.www.example.org.", dns.TypeTXT)
+	req.Extra = []dns.RR{test.A("www.example.org. 0 IN A 127.0.0.1")}
+	req.SetTsig("purge.example.org.", dns.HmacSHA256, 300, time.Now().Unix())
+	req.Compress = true
+	buf, _, err := dns.TsigGenerate(req, "c2VjcmV0", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := new(dns.Msg)
+	if err := signed.Unpack(buf); err != nil {
+		t.Fatal(err)
+	}
+	repacked, _ := signed.Pack()
+	if dns.TsigVerify(repacked, "c2VjcmV0", "", false) == nil {
+		t.Fatalf("Expected the signature to be invalid for the query packed again")
+	}
+
+	tests := []struct {
+		server string
+		rcode  int
+	}{
+		// The dns server verified the signature of the received query
+		{"dns://:53", dns.RcodeSuccess},
+		// DoH doesn't, and the signature can't be verified against the query packed again
+		{"https://:443", dns.RcodeRefused},
+	}
+	for i, tt := range tests {
+		ctx := context.WithValue(context.TODO(), dnsserver.Key{}, &dnsserver.Server{Addr: tt.server})
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		c.ServeDNS(ctx, rec, signed.Copy())
+		if rec.Msg.Rcode != tt.rcode {
+			t.Errorf("Test %d: expected rcode %s, got %s", i, dns.RcodeToString[tt.rcode], dns.RcodeToString[rec.Msg.Rcode])
+		}
+	}
+}
+
+func TestPurgeQueryDisabled(t *testing.T) {
+	c, _ := newTestAdmin(t)
+	c.Next = ttlBackend(60)
+
+	req := new(dns.Msg)
+	req.SetQuestion("_purge.www.example.org.", dns.TypeTXT)
+	req.SetTsig("purge.key.", dns.HmacSHA256, 300, time.Now().Unix())
+	c.ServeDNS(context.TODO(), dnstest.NewRecorder(&test.ResponseWriter{}), req)
+
+	if _, ok := c.pcache.Get(hash("www.example.org.", dns.TypeA, false, false)); !ok {
+		t.Errorf("Expected purge queries to be ignored when disabled")
+	}
+}
@@ -0,0 +1,5 @@
+package cache
+
+// Ready implements the ready.Readiness interface. The plugin is ready once the early refresh
+// pods have been synced from the Kubernetes API.
+func (c *Cache) Ready() bool { return c.k8sAPI.hasSynced() }
@@ -0,0 +1,37 @@
+package cache
+
+import (
+	"testing"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+func TestEarlyRefreshUntilSynced(t *testing.T) {
+	c := newTestK8sCache(false)
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	state := request.Request{W: &test.ResponseWriter{}, Req: req}
+
+	if c.Ready() {
+		t.Fatalf("Expected cache not to be ready before the k8sAPI has synced")
+	}
+	if c.NeedEarlyRefresh(state) {
+		t.Errorf("Expected no early refresh for unknown client by default")
+	}
+
+	c.earlyUntilSynced = true
+	if !c.NeedEarlyRefresh(state) {
+		t.Errorf("Expected early refresh for all clients until synced")
+	}
+
+	c.k8sAPI.synced.Store(true)
+	if !c.Ready() {
+		t.Errorf("Expected cache to be ready after the k8sAPI has synced")
+	}
+	if c.NeedEarlyRefresh(state) {
+		t.Errorf("Expected no early refresh for unknown client after sync")
+	}
+}
@@ -0,0 +1,331 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	discovery "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	kcache "k8s.io/client-go/tools/cache"
+
+	"github.com/coredns/coredns/plugin/pkg/cache"
+	ctls "github.com/coredns/coredns/plugin/pkg/tls"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	replicatePath      = "/v1/replicate"
+	replicateQueueLen  = 1000
+	replicateBatchSize = 100
+	replicateTimeout   = 2 * time.Second
+)
+
+// replicator propagates early cache inserts to the other CoreDNS replicas, and inserts the items
+// received from them. This keeps the early and late caches of all replicas consistent, so that
+// normal clients of one replica don't get answers before early refresh pods of another replica.
+type replicator struct {
+	addr      string   // listen address for peers
+	peers     []string // static peer addresses, host:port
+	service   string   // namespace/name of the headless Service to discover peers from
+	tokenFile string   // file with the shared secret of the replicas
+
+	token     []byte
+	tlsConfig *tls.Config // TLS config of the listener and the sender, if any
+	client    *http.Client
+	server    *http.Server
+	queue     chan snapshotEntry
+	stopChan  chan struct{}
+	done      sync.WaitGroup
+	localIPs  map[string]struct{}
+	endpoints kcache.SharedIndexInformer
+}
+
+func newReplicator(addr string) *replicator {
+	return &replicator{
+		addr:   addr,
+		client: &http.Client{Timeout: replicateTimeout},
+		queue:  make(chan snapshotEntry, replicateQueueLen),
+	}
+}
+
+// start starts listening for peers and sending queued items. Peers are discovered from the
+// Kubernetes API with k, if a service is configured.
+func (r *replicator) start(c *Cache, k *k8sAPI) error {
+	token, err := os.ReadFile(r.tokenFile)
+	if err != nil {
+		return err
+	}
+	r.token = bytes.TrimSpace(token)
+	if len(r.token) == 0 {
+		return errors.New("replication token file " + r.tokenFile + " is empty")
+	}
+	r.localIPs = localIPs()
+	r.stopChan = make(chan struct{})
+
+	if r.service != "" {
+		ns, name, _ := strings.Cut(r.service, "/")
+		r.watchEndpoints(k.client, ns, name)
+	}
+
+	ln, err := net.Listen("tcp", r.addr)
+	if err != nil {
+		return err
+	}
+	if r.tlsConfig != nil {
+		ln = tls.NewListener(ln, r.tlsConfig)
+	}
+	mux := http.NewServeMux()
+	mux.Handle(replicatePath, r.handler(c))
+	r.server = &http.Server{Handler: mux, ReadHeaderTimeout: replicateTimeout}
+
+	r.done.Add(2)
+	go func() {
+		defer r.done.Done()
+		if err := r.server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Replication listener on %s failed: %s", r.addr, err)
+		}
+	}()
+	go func() {
+		defer r.done.Done()
+		r.run()
+	}()
+	return nil
+}
+
+// stop stops the listener and the sender, if started.
+func (r *replicator) stop() {
+	if r.stopChan == nil {
+		return
+	}
+	close(r.stopChan)
+	r.server.Close()
+	r.done.Wait()
+	r.stopChan = nil
+}
+
+// setTLS makes r listen and send to its peers with TLS, using cfg.
+func (r *replicator) setTLS(cfg *tls.Config) {
+	r.tlsConfig = cfg
+	r.client.Transport = ctls.NewHTTPSTransport(cfg)
+}
+
+// enqueue queues item i with key from the early cache of type typ for sending to the peers. The
+// item is dropped if the queue is full.
+func (r *replicator) enqueue(key uint64, i *item, typ string) {
+	e, err := newSnapshotEntry(key, i, typ)
+	if err != nil {
+		log.Warningf("Not replicating cache item %s: %s", i.Name, err)
+		return
+	}
+	select {
+	case r.queue <- e:
+	default:
+		log.Debugf("Replication queue full, dropping %s", i.Name)
+	}
+}
+
+// run sends the queued items to the peers in batches until r.stopChan is closed.
+func (r *replicator) run() {
+	for {
+		select {
+		case <-r.stopChan:
+			return
+		case e := <-r.queue:
+			batch := []snapshotEntry{e}
+			for len(batch) < replicateBatchSize && len(r.queue) > 0 {
+				batch = append(batch, <-r.queue)
+			}
+			r.send(batch)
+		}
+	}
+}
+
+// send posts batch to all peers.
+func (r *replicator) send(batch []snapshotEntry) {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		log.Errorf("Failed to encode replication batch: %s", err)
+		return
+	}
+	scheme := "http://"
+	if r.tlsConfig != nil {
+		scheme = "https://"
+	}
+	for _, peer := range r.peerAddrs() {
+		req, err := http.NewRequest(http.MethodPost, scheme+peer+replicatePath, bytes.NewReader(body))
+		if err != nil {
+			log.Errorf("Failed to replicate to %s: %s", peer, err)
+			continue
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+string(r.token))
+		resp, err := r.client.Do(req)
+		if err != nil {
+			log.Debugf("Failed to replicate to %s: %s", peer, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			log.Debugf("Failed to replicate to %s: %s", peer, resp.Status)
+		}
+	}
+}
+
+// handler returns the HTTP handler that receives items from peers and inserts them into c.
+func (r *replicator) handler(c *Cache) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		auth := []byte(strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "))
+		if len(r.token) == 0 || subtle.ConstantTimeCompare(auth, r.token) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var batch []snapshotEntry
+		if err := json.NewDecoder(req.Body).Decode(&batch); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, e := range batch {
+			c.receive(e)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// peerAddrs returns the addresses of the peers, excluding ourselves.
+func (r *replicator) peerAddrs() []string {
+	peers := make([]string, 0, len(r.peers))
+	peers = append(peers, r.peers...)
+	if r.endpoints == nil {
+		return peers
+	}
+
+	_, port, _ := net.SplitHostPort(r.addr)
+	for _, obj := range r.endpoints.GetStore().List() {
+		slice, ok := obj.(*discovery.EndpointSlice)
+		if !ok {
+			continue
+		}
+		for _, ep := range slice.Endpoints {
+			if ep.Conditions.Ready != nil && !*ep.Conditions.Ready {
+				continue
+			}
+			if len(ep.Addresses) == 0 {
+				continue
+			}
+			if _, local := r.localIPs[ep.Addresses[0]]; local {
+				continue
+			}
+			peers = append(peers, net.JoinHostPort(ep.Addresses[0], port))
+		}
+	}
+	return peers
+}
+
+// watchEndpoints watches the EndpointSlices of the Service namespace/name to discover peers.
+func (r *replicator) watchEndpoints(client kubernetes.Interface, namespace, name string) {
+	selector := labels.SelectorFromSet(labels.Set{discovery.LabelServiceName: name})
+	lw := &kcache.ListWatch{
+		ListFunc:  endpointSliceListFunc(context.Background(), client, namespace, selector),
+		WatchFunc: endpointSliceWatchFunc(context.Background(), client, namespace, selector),
+	}
+	r.endpoints = kcache.NewSharedIndexInformer(lw, &discovery.EndpointSlice{}, defaultResyncPeriod, kcache.Indexers{})
+	go r.endpoints.Run(r.stopChan)
+}
+
+func endpointSliceListFunc(ctx context.Context, c kubernetes.Interface, ns string, s labels.Selector) func(metav1.ListOptions) (runtime.Object, error) {
+	return func(opts metav1.ListOptions) (runtime.Object, error) {
+		opts.LabelSelector = s.String()
+		return c.DiscoveryV1().EndpointSlices(ns).List(ctx, opts)
+	}
+}
+
+func endpointSliceWatchFunc(ctx context.Context, c kubernetes.Interface, ns string, s labels.Selector) func(metav1.ListOptions) (watch.Interface, error) {
+	return func(opts metav1.ListOptions) (watch.Interface, error) {
+		opts.LabelSelector = s.String()
+		return c.DiscoveryV1().EndpointSlices(ns).Watch(ctx, opts)
+	}
+}
+
+// localIPs returns the IP addresses of the local interfaces.
+func localIPs() map[string]struct{} {
+	ips := make(map[string]struct{})
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ips
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			ips[ipnet.IP.String()] = struct{}{}
+		}
+	}
+	return ips
+}
+
+// receive inserts an item received from a peer into the early cache, if it is newer than the
+// item we have, copies it to the late caches and publishes it to the feed. Received items are
+// not replicated again.
+func (c *Cache) receive(e snapshotEntry) {
+	i, err := e.item()
+	if err != nil {
+		log.Warningf("Ignoring replicated cache entry: %s", err)
+		return
+	}
+	if _, _, ok := i.keyBits(e.Key); !ok {
+		log.Warningf("Ignoring replicated cache entry for %s with a key of another question", i.Name)
+		return
+	}
+	now := c.now()
+	if i.ttl(now) <= 0 {
+		return
+	}
+
+	var dst *cache.Cache
+	switch e.Type {
+	case Success:
+		dst = c.pcache
+	case Denial:
+		dst = c.ncache
+	default:
+		return
+	}
+	if ii, ok := dst.Get(e.Key); ok && !ii.(*item).stored.Before(i.stored) {
+		return
+	}
+	dst.Add(e.Key, i)
+	if e.Type == Success {
+		c.ncache.Remove(e.Key)
+	}
+	c.copyToLate(e.Key, i, now, "")
+	c.publish(i)
+}
+
+// replicate queues item i with key for replication, if replication is enabled. Only successful
+// answers and denials are replicated.
+func (c *Cache) replicate(key uint64, i *item, typ string) {
+	if c.replicator == nil {
+		return
+	}
+	if i.Rcode != dns.RcodeSuccess && i.Rcode != dns.RcodeNameError {
+		return
+	}
+	c.replicator.enqueue(key, i, typ)
+}
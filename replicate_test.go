@@ -0,0 +1,228 @@
+package cache
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+// newTestReplicas returns n caches that replicate to each other over local HTTP servers.
+func newTestReplicas(t *testing.T, n int) []*Cache {
+	caches := make([]*Cache, n)
+	addrs := make([]string, n)
+	for i := range caches {
+		c := newTestK8sCache(true)
+		c.replicator = newReplicator("127.0.0.1:0")
+		c.replicator.token = []byte("secret")
+		s := httptest.NewServer(c.replicator.handler(c))
+		t.Cleanup(s.Close)
+		caches[i] = c
+		addrs[i] = strings.TrimPrefix(s.URL, "http://")
+	}
+	for i, c := range caches {
+		for j, addr := range addrs {
+			if i != j {
+				c.replicator.peers = append(c.replicator.peers, addr)
+			}
+		}
+		r := c.replicator
+		r.stopChan = make(chan struct{})
+		go r.run()
+		t.Cleanup(func() { close(r.stopChan) })
+	}
+	return caches
+}
+
+func TestReplication(t *testing.T) {
+	caches := newTestReplicas(t, 3)
+	ctx := context.TODO()
+
+	// The early refresh pod resolves example.org. through replica 0
+	caches[0].Next = ttlBackend(60)
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	caches[0].ServeDNS(ctx, dnstest.NewRecorder(&test.ResponseWriter{}), req.Copy())
+
+	for i, c := range caches[1:] {
+		c := c
+		waitFor(t, "replicated item", func() bool {
+			return c.pcache.Len() == 1 && c.latepcache.Len() == 1
+		})
+		c.Next = plugin.HandlerFunc(func(context.Context, dns.ResponseWriter, *dns.Msg) (int, error) {
+			return 255, nil // Below, a 255 means we tried querying upstream.
+		})
+
+		// Normal clients of the other replicas get the same late answer, without querying upstream
+		rec := dnstest.NewRecorder(&test.ResponseWriter6{})
+		if ret, _ := c.ServeDNS(ctx, rec, req.Copy()); ret == 255 {
+			t.Fatalf("Replica %d: expected replicated item to be served from the cache", i+1)
+		}
+		if ttl := rec.Msg.Answer[0].Header().Ttl; ttl < 64 || ttl > 65 {
+			t.Errorf("Replica %d: expected late TTL of 65s, got %d", i+1, ttl)
+		}
+		// Replicated items are not replicated again
+		if n := len(c.replicator.queue); n != 0 {
+			t.Errorf("Replica %d: expected empty replication queue, got %d items", i+1, n)
+		}
+	}
+}
+
+func TestReplicationOlderItem(t *testing.T) {
+	c := newTestK8sCache(true)
+	now := time.Now()
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	m.Answer = []dns.RR{test.A("example.org. 60 IN A 127.0.0.1")}
+	key := hash("example.org.", dns.TypeA, false, false)
+	c.pcache.Add(key, newItem(m, now, 60*time.Second))
+
+	m2 := m.Copy()
+	m2.Answer = []dns.RR{test.A("example.org. 60 IN A 127.0.0.2")}
+	older, err := newSnapshotEntry(key, newItem(m2, now.Add(-10*time.Second), 60*time.Second), Success)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.receive(older)
+	if i, _ := c.pcache.Get(key); i.(*item).Answer[0].(*dns.A).A.String() != "127.0.0.1" {
+		t.Errorf("Expected older replicated item to be ignored")
+	}
+
+	newer, err := newSnapshotEntry(key, newItem(m2, now.Add(10*time.Second), 60*time.Second), Success)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.receive(newer)
+	if i, _ := c.pcache.Get(key); i.(*item).Answer[0].(*dns.A).A.String() != "127.0.0.2" {
+		t.Errorf("Expected newer replicated item to replace the cached item")
+	}
+}
+
+func TestReplicationToken(t *testing.T) {
+	c := newTestK8sCache(false)
+	c.replicator = newReplicator("127.0.0.1:0")
+	c.replicator.token = []byte("secret")
+	s := httptest.NewServer(c.replicator.handler(c))
+	defer s.Close()
+
+	for _, tt := range []struct {
+		token    string
+		auth     string
+		expected int
+	}{
+		{"secret", "", http.StatusUnauthorized},
+		{"secret", "Bearer wrong", http.StatusUnauthorized},
+		{"secret", "Bearer secret", http.StatusNoContent},
+		{"", "", http.StatusUnauthorized}, // Never accept items without a token
+	} {
+		c.replicator.token = []byte(tt.token)
+		req, _ := http.NewRequest(http.MethodPost, s.URL+replicatePath, strings.NewReader("[]"))
+		if tt.auth != "" {
+			req.Header.Set("Authorization", tt.auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.expected {
+			t.Errorf("Authorization %q: expected status %d, got %d", tt.auth, tt.expected, resp.StatusCode)
+		}
+	}
+}
+
+func TestReplicationKey(t *testing.T) {
+	c := newTestK8sCache(true)
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	m.Answer = []dns.RR{test.A("example.org. 60 IN A 127.0.0.1")}
+	i := newItem(m, time.Now(), 60*time.Second)
+
+	// An entry for another name must not be stored under its key
+	forged, err := newSnapshotEntry(hash("other.org.", dns.TypeA, false, false), i, Success)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.receive(forged)
+	if c.pcache.Len() != 0 || c.latepcache.Len() != 0 {
+		t.Errorf("Expected replicated item with the key of another question to be ignored")
+	}
+
+	e, err := newSnapshotEntry(hash("example.org.", dns.TypeA, true, false), i, Success)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.receive(e)
+	if c.pcache.Len() != 1 {
+		t.Errorf("Expected replicated item with the key of its question to be stored")
+	}
+
+	// Keys are built from the lowercased qname
+	m.SetQuestion("Example.ORG.", dns.TypeAAAA)
+	m.Answer = []dns.RR{test.AAAA("Example.ORG. 60 IN AAAA ::1")}
+	e, err = newSnapshotEntry(hash("example.org.", dns.TypeAAAA, false, false), newItem(m, time.Now(), 60*time.Second), Success)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.receive(e)
+	if c.pcache.Len() != 2 {
+		t.Errorf("Expected replicated item for a mixed-case question to be stored")
+	}
+}
+
+func TestReplicationTLS(t *testing.T) {
+	c := newTestK8sCache(true)
+	c.replicator = newReplicator("127.0.0.1:0")
+	c.replicator.token = []byte("secret")
+	s := httptest.NewTLSServer(c.replicator.handler(c))
+	defer s.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(s.Certificate())
+	r := newReplicator("127.0.0.1:0")
+	r.token = []byte("secret")
+	r.setTLS(&tls.Config{RootCAs: roots})
+	r.peers = []string{strings.TrimPrefix(s.URL, "https://")}
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	m.Answer = []dns.RR{test.A("example.org. 60 IN A 127.0.0.1")}
+	e, err := newSnapshotEntry(hash("example.org.", dns.TypeA, false, false), newItem(m, time.Now(), 60*time.Second), Success)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.send([]snapshotEntry{e})
+	if c.pcache.Len() != 1 {
+		t.Errorf("Expected item replicated over TLS to be stored")
+	}
+}
+
+func TestReplicatorRestart(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestK8sCache(false)
+	r := newReplicator(freeAddr(t))
+	r.tokenFile = tokenFile
+	for n := 0; n < 2; n++ {
+		// A reload stops the replicator, and starts it again if the new instance fails
+		if err := r.start(c, c.k8sAPI); err != nil {
+			t.Fatalf("Start %d: %s", n, err)
+		}
+		r.stop()
+	}
+	r.stop()
+}
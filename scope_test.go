@@ -0,0 +1,90 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestEarlyRefreshScope(t *testing.T) {
+	tests := []struct {
+		earlyZones   []string
+		excludeZones []string
+		qname        string
+		scoped       bool
+	}{
+		{nil, nil, "example.org.", true},
+		{[]string{"example.org."}, nil, "www.example.org.", true},
+		{[]string{"example.org."}, nil, "example.net.", false},
+		{nil, []string{"cluster.local."}, "svc.cluster.local.", false},
+		{nil, []string{"cluster.local."}, "example.org.", true},
+		{[]string{"org."}, []string{"internal.example.org."}, "www.example.org.", true},
+		{[]string{"org."}, []string{"internal.example.org."}, "db.internal.example.org.", false},
+	}
+	for i, tt := range tests {
+		c := newTestK8sCache(true)
+		c.earlyZones = tt.earlyZones
+		c.excludeZones = tt.excludeZones
+		if scoped := c.earlyRefreshScope(tt.qname); scoped != tt.scoped {
+			t.Errorf("Test %d: expected scope %t for %s, got %t", i, tt.scoped, tt.qname, scoped)
+		}
+		extrattl := time.Duration(0)
+		if tt.scoped {
+			extrattl = 5 * time.Second
+		}
+		if d := c.extraTTL(tt.qname); d != extrattl {
+			t.Errorf("Test %d: expected extra TTL %s for %s, got %s", i, extrattl, tt.qname, d)
+		}
+	}
+}
+
+func TestEarlyRefreshExcluded(t *testing.T) {
+	c := newTestK8sCache(true)
+	c.excludeZones = []string{"cluster.local."}
+	c.Next = ttlBackend(10)
+	ctx := context.TODO()
+	req := new(dns.Msg)
+	req.SetQuestion("svc.cluster.local.", dns.TypeA)
+
+	// A normal client gets the answer of upstream, without extra TTL
+	misses := testutil.ToFloat64(cacheMisses.WithLabelValues("", c.zonesMetricLabel, c.viewMetricLabel))
+	rec := dnstest.NewRecorder(&test.ResponseWriter6{})
+	c.ServeDNS(ctx, rec, req.Copy())
+	if n := testutil.ToFloat64(cacheMisses.WithLabelValues("", c.zonesMetricLabel, c.viewMetricLabel)) - misses; n != 1 {
+		t.Errorf("Expected 1 cache miss, got %v", n)
+	}
+	if ttl := rec.Msg.Answer[0].Header().Ttl; ttl != 10 {
+		t.Errorf("Expected TTL 10, got %d", ttl)
+	}
+	if c.pcache.Len() != 1 || c.latepcache.Len() != 0 {
+		t.Errorf("Expected item in the early cache only, got %d early and %d late items", c.pcache.Len(), c.latepcache.Len())
+	}
+
+	// Early refresh pods and normal clients share the same item
+	c.Next = plugin.HandlerFunc(func(context.Context, dns.ResponseWriter, *dns.Msg) (int, error) {
+		return 255, nil // Below, a 255 means we tried querying upstream.
+	})
+	c.now = func() time.Time { return time.Now().Add(5 * time.Second) }
+	for _, w := range []dns.ResponseWriter{&test.ResponseWriter{}, &test.ResponseWriter6{}} {
+		rec := dnstest.NewRecorder(w)
+		if ret, _ := c.ServeDNS(ctx, rec, req.Copy()); ret == 255 {
+			t.Fatalf("Expected cached answer")
+		}
+		if ttl := rec.Msg.Answer[0].Header().Ttl; ttl != 5 {
+			t.Errorf("Expected TTL 5, got %d", ttl)
+		}
+	}
+
+	// After expiry, normal clients don't get the previous answer from a late cache
+	c.now = func() time.Time { return time.Now().Add(12 * time.Second) }
+	if ret, _ := c.ServeDNS(ctx, dnstest.NewRecorder(&test.ResponseWriter6{}), req.Copy()); ret != 255 {
+		t.Errorf("Expected upstream query after expiry, got %d", ret)
+	}
+}
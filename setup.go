@@ -3,6 +3,8 @@ package cache
 import (
 	"errors"
 	"fmt"
+	"net"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -12,6 +14,9 @@ import (
 	"github.com/coredns/coredns/plugin"
 	"github.com/coredns/coredns/plugin/pkg/cache"
 	clog "github.com/coredns/coredns/plugin/pkg/log"
+	ctls "github.com/coredns/coredns/plugin/pkg/tls"
+
+	"k8s.io/apimachinery/pkg/labels"
 )
 
 var log = clog.NewWithPlugin("k8s_cache")
@@ -26,15 +31,97 @@ func setup(c *caddy.Controller) error {
 
 	c.OnStartup(func() error {
 		ca.viewMetricLabel = dnsserver.GetConfig(c).ViewName
-		ca.k8sAPI, err = newK8sAPI()
-		if err != nil {
+		ca.tsigSecrets = dnsserver.GetConfig(c).TsigSecret
+		if ca.persistFile != "" {
+			if err := ca.loadSnapshot(); err != nil {
+				log.Warningf("Failed to restore cache from %s: %s", ca.persistFile, err)
+			}
+			ca.startPersist()
+		}
+		if err := ca.k8sAPI.start(); err != nil {
 			return err
 		}
+		if !ca.k8sAPI.waitForSync() {
+			log.Warningf("Early refresh pods not synced within %s, continuing in the background", ca.k8sAPI.syncTimeout)
+		}
+		if ca.adminAddr != "" {
+			if err := ca.startAdmin(); err != nil {
+				return err
+			}
+		}
+		if ca.prefetcher != nil {
+			ca.prefetcher.start()
+		}
+		if ca.hotRefresh != nil {
+			ca.startHotRefresh()
+		}
+		if ca.warm != nil {
+			ca.startWarm()
+		}
+		if ca.ackHold > 0 {
+			ca.startHeldSweep()
+		}
+		if ca.feed != nil {
+			if err := ca.feed.start(); err != nil {
+				return err
+			}
+		}
+		if ca.replicator != nil {
+			return ca.replicator.start(ca, ca.k8sAPI)
+		}
+		return nil
+	})
+
+	// On a reload, the new instance starts before the old one shuts down. Save the final snapshot
+	// before the new instance loads it, and free the listen addresses for it.
+	c.OnRestart(func() error {
+		if ca.replicator != nil {
+			ca.replicator.stop()
+		}
+		ca.stopAdmin()
+		if ca.feed != nil {
+			ca.feed.stop()
+		}
+		ca.stopPersist()
+		return nil
+	})
+
+	c.OnRestartFailed(func() error {
+		if ca.persistFile != "" {
+			ca.startPersist()
+		}
+		if ca.adminAddr != "" {
+			if err := ca.startAdmin(); err != nil {
+				return err
+			}
+		}
+		if ca.feed != nil {
+			if err := ca.feed.start(); err != nil {
+				return err
+			}
+		}
+		if ca.replicator != nil {
+			return ca.replicator.start(ca, ca.k8sAPI)
+		}
 		return nil
 	})
 
 	c.OnShutdown(func() error {
-		close(ca.k8sAPI.reflectorChan)
+		if ca.replicator != nil {
+			ca.replicator.stop()
+		}
+		ca.stopAdmin()
+		if ca.feed != nil {
+			ca.feed.stop()
+		}
+		ca.stopHotRefresh()
+		ca.stopWarm()
+		ca.stopHeldSweep()
+		if ca.prefetcher != nil {
+			ca.prefetcher.stop()
+		}
+		ca.k8sAPI.stop()
+		ca.stopPersist()
 		return nil
 	})
 
@@ -181,7 +268,7 @@ func cacheParse(c *caddy.Controller) (*Cache, error) {
 
 			case "serve_stale":
 				args := c.RemainingArgs()
-				if len(args) > 2 {
+				if len(args) > 3 {
 					return nil, c.ArgErr()
 				}
 				ca.staleUpTo = 1 * time.Hour
@@ -203,6 +290,20 @@ func cacheParse(c *caddy.Controller) (*Cache, error) {
 					}
 					ca.verifyStale = mode == "verify"
 				}
+				ca.staleTimeout = 0
+				if len(args) > 2 {
+					if !ca.verifyStale {
+						return nil, errors.New("serve_stale client timeout requires the verify refresh mode")
+					}
+					d, err := time.ParseDuration(args[2])
+					if err != nil {
+						return nil, err
+					}
+					if d <= 0 {
+						return nil, errors.New("invalid non-positive client timeout for serve_stale")
+					}
+					ca.staleTimeout = d
+				}
 			case "servfail":
 				args := c.RemainingArgs()
 				if len(args) != 1 {
@@ -256,6 +357,278 @@ func cacheParse(c *caddy.Controller) (*Cache, error) {
 				}
 				ca.keepttl = true
 			case "earlyrefresh":
+				// earlyrefresh DURATION [ZONES...]
+				args := c.RemainingArgs()
+				if len(args) < 1 {
+					return nil, c.ArgErr()
+				}
+				d, err := time.ParseDuration(args[0])
+				if err != nil {
+					return nil, err
+				}
+				if d < 0 {
+					return nil, errors.New("invalid negative duration for earlyrefresh")
+				}
+				if len(args) == 1 {
+					ca.extrattl = d
+					continue
+				}
+				for _, z := range args[1:] {
+					nz := plugin.Name(z).Normalize()
+					if nz == "" {
+						return nil, fmt.Errorf("invalid earlyrefresh zone: %s", z)
+					}
+					if nz == "." {
+						ca.extrattl = d
+						continue
+					}
+					if _, ok := ca.zonettls[nz]; ok {
+						return nil, fmt.Errorf("earlyrefresh zone specified more than once: %s", nz)
+					}
+					ca.zonettls[nz] = d
+					ca.ttlzones = append(ca.ttlzones, nz)
+				}
+			case "earlyrefresh_zones", "earlyrefresh_exclude":
+				// earlyrefresh_zones ZONES...
+				// earlyrefresh_exclude ZONES...
+				directive := c.Val()
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, c.ArgErr()
+				}
+				zones := make([]string, 0, len(args))
+				for _, z := range args {
+					nz := plugin.Name(z).Normalize()
+					if nz == "" {
+						return nil, fmt.Errorf("invalid %s zone: %s", directive, z)
+					}
+					zones = append(zones, nz)
+				}
+				if directive == "earlyrefresh_zones" {
+					ca.earlyZones = append(ca.earlyZones, zones...)
+				} else {
+					ca.excludeZones = append(ca.excludeZones, zones...)
+				}
+			case "earlyrefresh_denial":
+				args := c.RemainingArgs()
+				if len(args) != 0 {
+					return nil, c.ArgErr()
+				}
+				ca.latedenial = true
+			case "persist":
+				// persist FILE [INTERVAL]
+				args := c.RemainingArgs()
+				if len(args) < 1 || len(args) > 2 {
+					return nil, c.ArgErr()
+				}
+				ca.persistFile = args[0]
+				ca.persistInterval = defaultPersistInterval
+				if len(args) > 1 {
+					d, err := time.ParseDuration(args[1])
+					if err != nil {
+						return nil, err
+					}
+					if d <= 0 {
+						return nil, errors.New("persist interval must be positive")
+					}
+					ca.persistInterval = d
+				}
+			case "replicate":
+				// replicate ADDRESS TOKEN_FILE
+				args := c.RemainingArgs()
+				if len(args) != 2 {
+					return nil, c.ArgErr()
+				}
+				if _, _, err := net.SplitHostPort(args[0]); err != nil {
+					return nil, fmt.Errorf("invalid replicate address: %v", err)
+				}
+				if ca.replicator == nil {
+					ca.replicator = newReplicator(args[0])
+				}
+				ca.replicator.addr = args[0]
+				ca.replicator.tokenFile = args[1]
+			case "replicate_tls":
+				// replicate_tls CERT KEY [CA [SERVER_NAME]]
+				args := c.RemainingArgs()
+				if len(args) < 2 || len(args) > 4 {
+					return nil, c.ArgErr()
+				}
+				cfg, err := ctls.NewTLSConfigFromArgs(args[:min(len(args), 3)]...)
+				if err != nil {
+					return nil, err
+				}
+				if len(args) > 3 {
+					cfg.ServerName = args[3]
+				}
+				if ca.replicator == nil {
+					ca.replicator = newReplicator("")
+				}
+				ca.replicator.setTLS(cfg)
+			case "replicate_peers":
+				// replicate_peers NAMESPACE/SERVICE | ADDRESS...
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, c.ArgErr()
+				}
+				if ca.replicator == nil {
+					ca.replicator = newReplicator("")
+				}
+				if len(args) == 1 && strings.Count(args[0], "/") == 1 && !strings.Contains(args[0], ":") {
+					ca.replicator.service = args[0]
+					continue
+				}
+				for _, peer := range args {
+					if _, _, err := net.SplitHostPort(peer); err != nil {
+						return nil, fmt.Errorf("invalid replicate peer: %v", err)
+					}
+				}
+				ca.replicator.peers = append(ca.replicator.peers, args...)
+			case "admin":
+				// admin ADDRESS TOKEN_FILE
+				args := c.RemainingArgs()
+				if len(args) != 2 {
+					return nil, c.ArgErr()
+				}
+				if _, _, err := net.SplitHostPort(args[0]); err != nil {
+					return nil, fmt.Errorf("invalid admin address: %v", err)
+				}
+				ca.adminAddr = args[0]
+				ca.adminTokenFile = args[1]
+			case "purge_query":
+				// purge_query [KEYS...]
+				ca.purgeQuery = true
+				for _, k := range c.RemainingArgs() {
+					ca.purgeKeys = append(ca.purgeKeys, plugin.Name(k).Normalize())
+				}
+			case "change_webhook":
+				// change_webhook URL
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return nil, c.ArgErr()
+				}
+				u, err := url.Parse(args[0])
+				if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+					return nil, fmt.Errorf("invalid change_webhook URL: %s", args[0])
+				}
+				ca.changeWebhook = args[0]
+			case "feed":
+				// feed ADDRESS [TOKEN_FILE]
+				args := c.RemainingArgs()
+				if len(args) < 1 || len(args) > 2 {
+					return nil, c.ArgErr()
+				}
+				if _, _, err := net.SplitHostPort(args[0]); err != nil {
+					return nil, fmt.Errorf("invalid feed address: %v", err)
+				}
+				ca.feed = newFeedServer(ca, args[0])
+				if len(args) > 1 {
+					ca.feed.tokenFile = args[1]
+				}
+			case "prefetch_workers":
+				// prefetch_workers COUNT [QUEUE_LENGTH]
+				args := c.RemainingArgs()
+				if len(args) == 0 || len(args) > 2 {
+					return nil, c.ArgErr()
+				}
+				workers, err := strconv.Atoi(args[0])
+				if err != nil {
+					return nil, err
+				}
+				if workers <= 0 {
+					return nil, fmt.Errorf("prefetch_workers count should be positive: %d", workers)
+				}
+				queueLen := defaultPrefetchQueueLen
+				if len(args) > 1 {
+					queueLen, err = strconv.Atoi(args[1])
+					if err != nil {
+						return nil, err
+					}
+					if queueLen <= 0 {
+						return nil, fmt.Errorf("prefetch_workers queue length should be positive: %d", queueLen)
+					}
+				}
+				ca.prefetcher = newPrefetcher(ca, workers, queueLen)
+			case "hot_refresh":
+				// hot_refresh AMOUNT [INTERVAL]
+				args := c.RemainingArgs()
+				if len(args) == 0 || len(args) > 2 {
+					return nil, c.ArgErr()
+				}
+				amount, err := strconv.Atoi(args[0])
+				if err != nil {
+					return nil, err
+				}
+				if amount <= 0 {
+					return nil, fmt.Errorf("hot_refresh amount should be positive: %d", amount)
+				}
+				interval := defaultHotRefreshInterval
+				if len(args) > 1 {
+					interval, err = time.ParseDuration(args[1])
+					if err != nil {
+						return nil, err
+					}
+					if interval <= 0 {
+						return nil, fmt.Errorf("hot_refresh interval should be positive: %s", interval)
+					}
+				}
+				ca.hotRefresh = &hotRefresher{amount: amount, interval: interval}
+			case "keep_warm":
+				// keep_warm NAMESPACE/CONFIGMAP [INTERVAL]
+				args := c.RemainingArgs()
+				if len(args) == 0 || len(args) > 2 {
+					return nil, c.ArgErr()
+				}
+				ns, name, ok := strings.Cut(args[0], "/")
+				if !ok || ns == "" || name == "" || strings.Contains(name, "/") {
+					return nil, fmt.Errorf("keep_warm ConfigMap must be NAMESPACE/NAME: %q", args[0])
+				}
+				interval := defaultWarmInterval
+				if len(args) > 1 {
+					d, err := time.ParseDuration(args[1])
+					if err != nil {
+						return nil, err
+					}
+					if d <= 0 {
+						return nil, fmt.Errorf("keep_warm interval should be positive: %s", d)
+					}
+					interval = d
+				}
+				ca.warm = newWarmer(ns, name, interval)
+			case "extended_errors":
+				// extended_errors [success|denial...]
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					args = []string{Success, Denial}
+				}
+				for _, arg := range args {
+					switch arg {
+					case Success:
+						ca.edeSuccess = true
+					case Denial:
+						ca.edeDenial = true
+					default:
+						return nil, fmt.Errorf("cache type for extended_errors must be %q or %q; found: %q", Success, Denial, arg)
+					}
+				}
+			case "late_fallback":
+				// late_fallback [DURATION]
+				args := c.RemainingArgs()
+				if len(args) > 1 {
+					return nil, c.ArgErr()
+				}
+				ca.lateFallback = defaultLateFallback
+				if len(args) > 0 {
+					d, err := time.ParseDuration(args[0])
+					if err != nil {
+						return nil, err
+					}
+					if d <= 0 {
+						return nil, errors.New("late_fallback duration must be positive")
+					}
+					ca.lateFallback = d
+				}
+			case "ack_hold":
+				// ack_hold DURATION
 				args := c.RemainingArgs()
 				if len(args) != 1 {
 					return nil, c.ArgErr()
@@ -264,7 +637,79 @@ func cacheParse(c *caddy.Controller) (*Cache, error) {
 				if err != nil {
 					return nil, err
 				}
-				ca.extrattl = d
+				if d <= 0 {
+					return nil, errors.New("ack_hold duration must be positive")
+				}
+				ca.ackHold = d
+			case "early_refresh_selector":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, c.ArgErr()
+				}
+				selectorString := strings.Join(args, " ")
+				selector, err := labels.Parse(selectorString)
+				if err != nil {
+					return nil, fmt.Errorf("unable to parse early_refresh_selector value: '%v': %v", selectorString, err)
+				}
+				ca.k8sAPI.labelSelector = selector
+			case "namespaces":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, c.ArgErr()
+				}
+				ca.k8sAPI.namespaces = append(ca.k8sAPI.namespaces, args...)
+			case "namespace_labels":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, c.ArgErr()
+				}
+				selectorString := strings.Join(args, " ")
+				selector, err := labels.Parse(selectorString)
+				if err != nil {
+					return nil, fmt.Errorf("unable to parse namespace_labels value: '%v': %v", selectorString, err)
+				}
+				ca.k8sAPI.namespaceSelector = selector
+			case "early_refresh_service_accounts":
+				// early_refresh_service_accounts NAMESPACE/NAME...
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, c.ArgErr()
+				}
+				if ca.k8sAPI.serviceAccounts == nil {
+					ca.k8sAPI.serviceAccounts = make(map[string]struct{})
+				}
+				for _, arg := range args {
+					ns, name, ok := strings.Cut(arg, "/")
+					if !ok || ns == "" || name == "" || strings.Contains(name, "/") {
+						return nil, fmt.Errorf("early_refresh_service_accounts entry must be NAMESPACE/NAME: %q", arg)
+					}
+					ca.k8sAPI.serviceAccounts[arg] = struct{}{}
+				}
+			case "detect_ip_collisions":
+				args := c.RemainingArgs()
+				if len(args) != 0 {
+					return nil, c.ArgErr()
+				}
+				ca.k8sAPI.detectCollisions = true
+			case "sync_timeout":
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return nil, c.ArgErr()
+				}
+				d, err := time.ParseDuration(args[0])
+				if err != nil {
+					return nil, err
+				}
+				if d < 0 {
+					return nil, errors.New("invalid negative duration for sync_timeout")
+				}
+				ca.k8sAPI.syncTimeout = d
+			case "early_refresh_until_synced":
+				args := c.RemainingArgs()
+				if len(args) != 0 {
+					return nil, c.ArgErr()
+				}
+				ca.earlyUntilSynced = true
 			case "api-endpoint":
 				args := c.RemainingArgs()
 				if len(args) > 0 {
@@ -289,11 +734,28 @@ func cacheParse(c *caddy.Controller) (*Cache, error) {
 			}
 		}
 
+		if ca.ackHold > 0 && (ca.feed == nil || ca.feed.tokenFile == "") {
+			return nil, c.Errf("ack_hold requires feed with a TOKEN_FILE")
+		}
+		if ca.ackHold > 0 && ca.replicator != nil {
+			// Acknowledgements only release the hold on the replica that receives them
+			return nil, c.Errf("ack_hold cannot be used with replicate")
+		}
+		if ca.replicator != nil && ca.replicator.addr == "" {
+			return nil, c.Errf("replicate_peers and replicate_tls require replicate")
+		}
+		if len(ca.k8sAPI.namespaces) > 0 && ca.k8sAPI.namespaceSelector != nil {
+			return nil, c.Errf("namespaces and namespace_labels cannot both be set")
+		}
+
 		ca.Zones = origins
 		ca.zonesMetricLabel = strings.Join(origins, ",")
 		ca.pcache = cache.New(ca.pcap)
 		ca.ncache = cache.New(ca.ncap)
 		ca.latepcache = cache.New(ca.pcap)
+		if ca.latedenial {
+			ca.latencache = cache.New(ca.ncap)
+		}
 	}
 
 	return ca, nil
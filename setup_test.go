@@ -2,6 +2,7 @@ package cache
 
 import (
 	"fmt"
+	"reflect"
 	"testing"
 	"time"
 
@@ -117,25 +118,31 @@ func TestSetup(t *testing.T) {
 
 func TestServeStale(t *testing.T) {
 	tests := []struct {
-		input       string
-		shouldErr   bool
-		staleUpTo   time.Duration
-		verifyStale bool
+		input        string
+		shouldErr    bool
+		staleUpTo    time.Duration
+		verifyStale  bool
+		staleTimeout time.Duration
 	}{
-		{"serve_stale", false, 1 * time.Hour, false},
-		{"serve_stale 20m", false, 20 * time.Minute, false},
-		{"serve_stale 1h20m", false, 80 * time.Minute, false},
-		{"serve_stale 0m", false, 0, false},
-		{"serve_stale 0", false, 0, false},
-		{"serve_stale 0 verify", false, 0, true},
-		{"serve_stale 0 immediate", false, 0, false},
-		{"serve_stale 0 VERIFY", false, 0, true},
+		{"serve_stale", false, 1 * time.Hour, false, 0},
+		{"serve_stale 20m", false, 20 * time.Minute, false, 0},
+		{"serve_stale 1h20m", false, 80 * time.Minute, false, 0},
+		{"serve_stale 0m", false, 0, false, 0},
+		{"serve_stale 0", false, 0, false, 0},
+		{"serve_stale 0 verify", false, 0, true, 0},
+		{"serve_stale 0 immediate", false, 0, false, 0},
+		{"serve_stale 0 VERIFY", false, 0, true, 0},
+		{"serve_stale 1h verify 1800ms", false, 1 * time.Hour, true, 1800 * time.Millisecond},
 		// fails
-		{"serve_stale 20", true, 0, false},
-		{"serve_stale -20m", true, 0, false},
-		{"serve_stale aa", true, 0, false},
-		{"serve_stale 1m nono", true, 0, false},
-		{"serve_stale 0 after nono", true, 0, false},
+		{"serve_stale 20", true, 0, false, 0},
+		{"serve_stale -20m", true, 0, false, 0},
+		{"serve_stale aa", true, 0, false, 0},
+		{"serve_stale 1m nono", true, 0, false, 0},
+		{"serve_stale 0 after nono", true, 0, false, 0},
+		{"serve_stale 1h immediate 1s", true, 0, false, 0},
+		{"serve_stale 1h verify 0s", true, 0, false, 0},
+		{"serve_stale 1h verify 1", true, 0, false, 0},
+		{"serve_stale 1h verify 1s 2s", true, 0, false, 0},
 	}
 	for i, test := range tests {
 		c := caddy.NewTestController("dns", fmt.Sprintf("cache {\n%s\n}", test.input))
@@ -153,6 +160,9 @@ func TestServeStale(t *testing.T) {
 		if ca.staleUpTo != test.staleUpTo {
 			t.Errorf("Test %v: Expected stale %v but found: %v", i, test.staleUpTo, ca.staleUpTo)
 		}
+		if ca.staleTimeout != test.staleTimeout {
+			t.Errorf("Test %v: Expected client timeout %v but found: %v", i, test.staleTimeout, ca.staleTimeout)
+		}
 	}
 }
 
@@ -260,3 +270,688 @@ func TestKeepttl(t *testing.T) {
 		}
 	}
 }
+
+func TestEarlyRefreshSelector(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		selector  string
+	}{
+		{"", false, defaultEarlyRefreshSelector},
+		{"early_refresh_selector app=fqdn-controller", false, "app=fqdn-controller"},
+		{"early_refresh_selector app=fqdn-controller,tier!=test", false, "app=fqdn-controller,tier!=test"},
+		{"early_refresh_selector app in (fqdn-controller, policy-controller)", false, "app in (fqdn-controller,policy-controller)"},
+		{"early_refresh_selector !legacy", false, "!legacy"},
+		// negative
+		{"early_refresh_selector", true, ""},
+		{"early_refresh_selector app in (a", true, ""},
+		{"early_refresh_selector =fqdn-controller", true, ""},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", fmt.Sprintf("cache {\n%s\n}", test.input))
+		ca, err := cacheParse(c)
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %v: Expected error but found nil", i)
+			continue
+		} else if !test.shouldErr && err != nil {
+			t.Errorf("Test %v: Expected no error but found error: %v", i, err)
+			continue
+		}
+		if test.shouldErr {
+			continue
+		}
+		if got := ca.k8sAPI.labelSelector.String(); got != test.selector {
+			t.Errorf("Test %v: Expected selector %q but found: %q", i, test.selector, got)
+		}
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	tests := []struct {
+		input             string
+		shouldErr         bool
+		namespaces        []string
+		namespaceSelector string
+	}{
+		{"namespaces team-a", false, []string{"team-a"}, ""},
+		{"namespaces team-a team-b\nnamespaces team-c", false, []string{"team-a", "team-b", "team-c"}, ""},
+		{"namespace_labels dns-early-refresh=enabled", false, nil, "dns-early-refresh=enabled"},
+		{"namespace_labels environment in (production, staging)", false, nil, "environment in (production,staging)"},
+		// negative
+		{"namespaces", true, nil, ""},
+		{"namespace_labels", true, nil, ""},
+		{"namespace_labels environment in (production", true, nil, ""},
+		{"namespaces team-a\nnamespace_labels dns-early-refresh=enabled", true, nil, ""},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", fmt.Sprintf("cache {\n%s\n}", test.input))
+		ca, err := cacheParse(c)
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %v: Expected error but found nil", i)
+			continue
+		} else if !test.shouldErr && err != nil {
+			t.Errorf("Test %v: Expected no error but found error: %v", i, err)
+			continue
+		}
+		if test.shouldErr {
+			continue
+		}
+		if fmt.Sprintf("%v", test.namespaces) != fmt.Sprintf("%v", ca.k8sAPI.namespaces) {
+			t.Errorf("Test %v: Expected namespaces %v but got: %v", i, test.namespaces, ca.k8sAPI.namespaces)
+		}
+		selector := ""
+		if ca.k8sAPI.namespaceSelector != nil {
+			selector = ca.k8sAPI.namespaceSelector.String()
+		}
+		if selector != test.namespaceSelector {
+			t.Errorf("Test %v: Expected namespace selector %q but got: %q", i, test.namespaceSelector, selector)
+		}
+	}
+}
+
+func TestSync(t *testing.T) {
+	tests := []struct {
+		input            string
+		shouldErr        bool
+		syncTimeout      time.Duration
+		earlyUntilSynced bool
+	}{
+		{"", false, defaultSyncTimeout, false},
+		{"sync_timeout 30s", false, 30 * time.Second, false},
+		{"sync_timeout 0s", false, 0, false},
+		{"early_refresh_until_synced", false, defaultSyncTimeout, true},
+		{"sync_timeout 1m\nearly_refresh_until_synced", false, time.Minute, true},
+		// negative
+		{"sync_timeout", true, 0, false},
+		{"sync_timeout 30", true, 0, false},
+		{"sync_timeout -1s", true, 0, false},
+		{"early_refresh_until_synced yes", true, 0, false},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", fmt.Sprintf("cache {\n%s\n}", test.input))
+		ca, err := cacheParse(c)
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %v: Expected error but found nil", i)
+			continue
+		} else if !test.shouldErr && err != nil {
+			t.Errorf("Test %v: Expected no error but found error: %v", i, err)
+			continue
+		}
+		if test.shouldErr {
+			continue
+		}
+		if ca.k8sAPI.syncTimeout != test.syncTimeout {
+			t.Errorf("Test %v: Expected sync timeout %v but found: %v", i, test.syncTimeout, ca.k8sAPI.syncTimeout)
+		}
+		if ca.earlyUntilSynced != test.earlyUntilSynced {
+			t.Errorf("Test %v: Expected early_refresh_until_synced %v but found: %v", i, test.earlyUntilSynced, ca.earlyUntilSynced)
+		}
+	}
+}
+
+func TestEarlyRefresh(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		extrattl  time.Duration
+		zonettls  map[string]time.Duration
+	}{
+		{"earlyrefresh 5s", false, 5 * time.Second, map[string]time.Duration{}},
+		{"earlyrefresh 5s .", false, 5 * time.Second, map[string]time.Duration{}},
+		{"earlyrefresh 5s\nearlyrefresh 30s corp.example.com example.org", false, 5 * time.Second,
+			map[string]time.Duration{"corp.example.com.": 30 * time.Second, "example.org.": 30 * time.Second}},
+		{"earlyrefresh 30s corp.example.com\nearlyrefresh 10s eu.corp.example.com", false, 0,
+			map[string]time.Duration{"corp.example.com.": 30 * time.Second, "eu.corp.example.com.": 10 * time.Second}},
+		// negative
+		{"earlyrefresh", true, 0, nil},
+		{"earlyrefresh 5", true, 0, nil},
+		{"earlyrefresh -5s", true, 0, nil},
+		{"earlyrefresh 5s example.org\nearlyrefresh 10s example.org", true, 0, nil},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", fmt.Sprintf("cache {\n%s\n}", test.input))
+		ca, err := cacheParse(c)
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %v: Expected error but found nil", i)
+			continue
+		} else if !test.shouldErr && err != nil {
+			t.Errorf("Test %v: Expected no error but found error: %v", i, err)
+			continue
+		}
+		if test.shouldErr {
+			continue
+		}
+		if ca.extrattl != test.extrattl {
+			t.Errorf("Test %v: Expected earlyrefresh %v but found: %v", i, test.extrattl, ca.extrattl)
+		}
+		if fmt.Sprintf("%v", test.zonettls) != fmt.Sprintf("%v", ca.zonettls) {
+			t.Errorf("Test %v: Expected zone earlyrefresh %v but found: %v", i, test.zonettls, ca.zonettls)
+		}
+	}
+}
+
+func TestReplicate(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		addr      string
+		tokenFile string
+		service   string
+		peers     []string
+	}{
+		{"", false, "", "", "", nil},
+		{"replicate :8054 /etc/coredns/replicate-token", false, ":8054", "/etc/coredns/replicate-token", "", nil},
+		{"replicate :8054 token\nreplicate_peers kube-system/coredns-peers", false, ":8054", "token", "kube-system/coredns-peers", nil},
+		{"replicate_peers 10.0.0.2:8054 10.0.0.3:8054\nreplicate 0.0.0.0:8054 token", false, "0.0.0.0:8054", "token", "", []string{"10.0.0.2:8054", "10.0.0.3:8054"}},
+		// negative
+		{"replicate", true, "", "", "", nil},
+		{"replicate :8054", true, "", "", "", nil}, // The token is required
+		{"replicate 8054 token", true, "", "", "", nil},
+		{"replicate :8054 token extra", true, "", "", "", nil},
+		{"replicate :8054 token\nreplicate_peers", true, "", "", "", nil},
+		{"replicate :8054 token\nreplicate_peers 10.0.0.2", true, "", "", "", nil},
+		{"replicate_peers kube-system/coredns-peers", true, "", "", "", nil},
+		{"replicate :8054 token\nreplicate_tls cert.pem", true, "", "", "", nil},
+		{"replicate :8054 token\nreplicate_tls missing-cert.pem missing-key.pem", true, "", "", "", nil},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", fmt.Sprintf("cache {\n%s\n}", test.input))
+		ca, err := cacheParse(c)
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %v: Expected error but found nil", i)
+			continue
+		} else if !test.shouldErr && err != nil {
+			t.Errorf("Test %v: Expected no error but found error: %v", i, err)
+			continue
+		}
+		if test.shouldErr {
+			continue
+		}
+		if test.addr == "" {
+			if ca.replicator != nil {
+				t.Errorf("Test %v: Expected replication to be disabled", i)
+			}
+			continue
+		}
+		r := ca.replicator
+		if r.addr != test.addr || r.tokenFile != test.tokenFile || r.service != test.service {
+			t.Errorf("Test %v: Expected replicate %q %q %q but found: %q %q %q", i,
+				test.addr, test.tokenFile, test.service, r.addr, r.tokenFile, r.service)
+		}
+		if fmt.Sprintf("%v", test.peers) != fmt.Sprintf("%v", r.peers) {
+			t.Errorf("Test %v: Expected replicate peers %v but found: %v", i, test.peers, r.peers)
+		}
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		addr      string
+	}{
+		{"", false, ""},
+		{"admin localhost:8055 /etc/coredns/admin-token", false, "localhost:8055"},
+		{"admin :8055 token", false, ":8055"},
+		// negative
+		{"admin", true, ""},
+		{"admin :8055", true, ""}, // The token file is required
+		{"admin 8055 token", true, ""},
+		{"admin :8055 token extra", true, ""},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", fmt.Sprintf("cache {\n%s\n}", test.input))
+		ca, err := cacheParse(c)
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %v: Expected error but found nil", i)
+			continue
+		} else if !test.shouldErr && err != nil {
+			t.Errorf("Test %v: Expected no error but found error: %v", i, err)
+			continue
+		}
+		if test.shouldErr {
+			continue
+		}
+		if ca.adminAddr != test.addr {
+			t.Errorf("Test %v: Expected admin address %q but found: %q", i, test.addr, ca.adminAddr)
+		}
+	}
+}
+
+func TestPurgeQuerySetup(t *testing.T) {
+	tests := []struct {
+		input      string
+		shouldErr  bool
+		purgeQuery bool
+		purgeKeys  []string
+	}{
+		{"", false, false, nil},
+		{"purge_query", false, true, nil},
+		{"purge_query Purge.Key other.key.", false, true, []string{"purge.key.", "other.key."}},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", fmt.Sprintf("cache {\n%s\n}", test.input))
+		ca, err := cacheParse(c)
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %v: Expected error but found nil", i)
+			continue
+		} else if !test.shouldErr && err != nil {
+			t.Errorf("Test %v: Expected no error but found error: %v", i, err)
+			continue
+		}
+		if test.shouldErr {
+			continue
+		}
+		if ca.purgeQuery != test.purgeQuery {
+			t.Errorf("Test %v: Expected purge_query %v but found: %v", i, test.purgeQuery, ca.purgeQuery)
+		}
+		if fmt.Sprintf("%v", test.purgeKeys) != fmt.Sprintf("%v", ca.purgeKeys) {
+			t.Errorf("Test %v: Expected purge keys %v but found: %v", i, test.purgeKeys, ca.purgeKeys)
+		}
+	}
+}
+
+func TestChangeWebhook(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		webhook   string
+	}{
+		{"", false, ""},
+		{"change_webhook http://fqdn-controller.kube-system:8080/changes", false, "http://fqdn-controller.kube-system:8080/changes"},
+		{"change_webhook https://example.org/hook", false, "https://example.org/hook"},
+		// negative
+		{"change_webhook", true, ""},
+		{"change_webhook example.org/hook", true, ""},
+		{"change_webhook ftp://example.org/hook", true, ""},
+		{"change_webhook http://a http://b", true, ""},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", fmt.Sprintf("cache {\n%s\n}", test.input))
+		ca, err := cacheParse(c)
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %v: Expected error but found nil", i)
+			continue
+		} else if !test.shouldErr && err != nil {
+			t.Errorf("Test %v: Expected no error but found error: %v", i, err)
+			continue
+		}
+		if test.shouldErr {
+			continue
+		}
+		if ca.changeWebhook != test.webhook {
+			t.Errorf("Test %v: Expected change webhook %q but found: %q", i, test.webhook, ca.changeWebhook)
+		}
+	}
+}
+
+func TestFeedSetup(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		addr      string
+	}{
+		{"", false, ""},
+		{"feed :8056", false, ":8056"},
+		{"feed :8056 /etc/coredns/feed-token", false, ":8056"},
+		// negative
+		{"feed", true, ""},
+		{"feed 8056", true, ""},
+		{"feed :8056 token extra", true, ""},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", fmt.Sprintf("cache {\n%s\n}", test.input))
+		ca, err := cacheParse(c)
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %v: Expected error but found nil", i)
+			continue
+		} else if !test.shouldErr && err != nil {
+			t.Errorf("Test %v: Expected no error but found error: %v", i, err)
+			continue
+		}
+		if test.shouldErr {
+			continue
+		}
+		addr := ""
+		if ca.feed != nil {
+			addr = ca.feed.addr
+		}
+		if addr != test.addr {
+			t.Errorf("Test %v: Expected feed address %q but found: %q", i, test.addr, addr)
+		}
+	}
+}
+
+func TestAckHoldSetup(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		ackHold   time.Duration
+	}{
+		{"", false, 0},
+		{"feed :8056 token\nack_hold 30s", false, 30 * time.Second},
+		// negative
+		{"ack_hold 30s", true, 0},
+		{"feed :8056\nack_hold 30s", true, 0}, // Acknowledgements require a token
+		{"feed :8056 token\nreplicate :8054 token\nack_hold 30s", true, 0},
+		{"feed :8056 token\nack_hold", true, 0},
+		{"feed :8056 token\nack_hold 30", true, 0},
+		{"feed :8056 token\nack_hold 0s", true, 0},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", fmt.Sprintf("cache {\n%s\n}", test.input))
+		ca, err := cacheParse(c)
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %v: Expected error but found nil", i)
+			continue
+		} else if !test.shouldErr && err != nil {
+			t.Errorf("Test %v: Expected no error but found error: %v", i, err)
+			continue
+		}
+		if test.shouldErr {
+			continue
+		}
+		if ca.ackHold != test.ackHold {
+			t.Errorf("Test %v: Expected ack_hold %v but found: %v", i, test.ackHold, ca.ackHold)
+		}
+	}
+}
+
+func TestLateFallbackSetup(t *testing.T) {
+	tests := []struct {
+		input        string
+		shouldErr    bool
+		lateFallback time.Duration
+	}{
+		{"", false, 0},
+		{"late_fallback", false, defaultLateFallback},
+		{"late_fallback 10m", false, 10 * time.Minute},
+		// negative
+		{"late_fallback 10", true, 0},
+		{"late_fallback 0s", true, 0},
+		{"late_fallback 10m 20m", true, 0},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", fmt.Sprintf("cache {\n%s\n}", test.input))
+		ca, err := cacheParse(c)
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %v: Expected error but found nil", i)
+			continue
+		} else if !test.shouldErr && err != nil {
+			t.Errorf("Test %v: Expected no error but found error: %v", i, err)
+			continue
+		}
+		if test.shouldErr {
+			continue
+		}
+		if ca.lateFallback != test.lateFallback {
+			t.Errorf("Test %v: Expected late_fallback %v but found: %v", i, test.lateFallback, ca.lateFallback)
+		}
+	}
+}
+
+func TestExtendedErrorsSetup(t *testing.T) {
+	tests := []struct {
+		input      string
+		shouldErr  bool
+		edeSuccess bool
+		edeDenial  bool
+	}{
+		{"", false, false, false},
+		{"extended_errors", false, true, true},
+		{"extended_errors success", false, true, false},
+		{"extended_errors denial", false, false, true},
+		{"extended_errors denial success", false, true, true},
+		// negative
+		{"extended_errors stale", true, false, false},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", fmt.Sprintf("cache {\n%s\n}", test.input))
+		ca, err := cacheParse(c)
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %v: Expected error but found nil", i)
+			continue
+		} else if !test.shouldErr && err != nil {
+			t.Errorf("Test %v: Expected no error but found error: %v", i, err)
+			continue
+		}
+		if test.shouldErr {
+			continue
+		}
+		if ca.edeSuccess != test.edeSuccess || ca.edeDenial != test.edeDenial {
+			t.Errorf("Test %v: Expected extended errors %v/%v but found: %v/%v", i, test.edeSuccess, test.edeDenial, ca.edeSuccess, ca.edeDenial)
+		}
+	}
+}
+
+func TestPrefetchWorkersSetup(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		workers   int
+		queueLen  int
+	}{
+		{"", false, 0, 0},
+		{"prefetch_workers 4", false, 4, defaultPrefetchQueueLen},
+		{"prefetch_workers 4 100", false, 4, 100},
+		// negative
+		{"prefetch_workers", true, 0, 0},
+		{"prefetch_workers 0", true, 0, 0},
+		{"prefetch_workers four", true, 0, 0},
+		{"prefetch_workers 4 0", true, 0, 0},
+		{"prefetch_workers 4 100 1", true, 0, 0},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", fmt.Sprintf("cache {\n%s\n}", test.input))
+		ca, err := cacheParse(c)
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %v: Expected error but found nil", i)
+			continue
+		} else if !test.shouldErr && err != nil {
+			t.Errorf("Test %v: Expected no error but found error: %v", i, err)
+			continue
+		}
+		if test.shouldErr {
+			continue
+		}
+		if test.workers == 0 {
+			if ca.prefetcher != nil {
+				t.Errorf("Test %v: Expected no prefetch workers", i)
+			}
+			continue
+		}
+		if ca.prefetcher == nil || ca.prefetcher.workers != test.workers || ca.prefetcher.queueLen != test.queueLen {
+			t.Errorf("Test %v: Expected %d prefetch workers with queue length %d but found: %+v", i, test.workers, test.queueLen, ca.prefetcher)
+		}
+	}
+}
+
+func TestHotRefreshSetup(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		amount    int
+		interval  time.Duration
+	}{
+		{"", false, 0, 0},
+		{"hot_refresh 10", false, 10, defaultHotRefreshInterval},
+		{"hot_refresh 10 1s", false, 10, time.Second},
+		// negative
+		{"hot_refresh", true, 0, 0},
+		{"hot_refresh 0", true, 0, 0},
+		{"hot_refresh ten", true, 0, 0},
+		{"hot_refresh 10 1", true, 0, 0},
+		{"hot_refresh 10 0s", true, 0, 0},
+		{"hot_refresh 10 1s 2s", true, 0, 0},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", fmt.Sprintf("cache {\n%s\n}", test.input))
+		ca, err := cacheParse(c)
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %v: Expected error but found nil", i)
+			continue
+		} else if !test.shouldErr && err != nil {
+			t.Errorf("Test %v: Expected no error but found error: %v", i, err)
+			continue
+		}
+		if test.shouldErr {
+			continue
+		}
+		if test.amount == 0 {
+			if ca.hotRefresh != nil {
+				t.Errorf("Test %v: Expected no hot refresh", i)
+			}
+			continue
+		}
+		if ca.hotRefresh == nil || ca.hotRefresh.amount != test.amount || ca.hotRefresh.interval != test.interval {
+			t.Errorf("Test %v: Expected hot refresh of %d hits every %v but found: %+v", i, test.amount, test.interval, ca.hotRefresh)
+		}
+	}
+}
+
+func TestKeepWarmSetup(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		namespace string
+		name      string
+		interval  time.Duration
+	}{
+		{"", false, "", "", 0},
+		{"keep_warm kube-system/warm-names", false, "kube-system", "warm-names", defaultWarmInterval},
+		{"keep_warm kube-system/warm-names 1m", false, "kube-system", "warm-names", time.Minute},
+		// negative
+		{"keep_warm", true, "", "", 0},
+		{"keep_warm warm-names", true, "", "", 0},
+		{"keep_warm /warm-names", true, "", "", 0},
+		{"keep_warm kube-system/", true, "", "", 0},
+		{"keep_warm a/b/c", true, "", "", 0},
+		{"keep_warm kube-system/warm-names 0s", true, "", "", 0},
+		{"keep_warm kube-system/warm-names 1m 2m", true, "", "", 0},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", fmt.Sprintf("cache {\n%s\n}", test.input))
+		ca, err := cacheParse(c)
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %v: Expected error but found nil", i)
+			continue
+		} else if !test.shouldErr && err != nil {
+			t.Errorf("Test %v: Expected no error but found error: %v", i, err)
+			continue
+		}
+		if test.shouldErr {
+			continue
+		}
+		if test.name == "" {
+			if ca.warm != nil {
+				t.Errorf("Test %v: Expected no keep_warm", i)
+			}
+			continue
+		}
+		if ca.warm == nil || ca.warm.namespace != test.namespace || ca.warm.name != test.name || ca.warm.interval != test.interval {
+			t.Errorf("Test %v: Expected keep_warm %s/%s every %v but found: %+v", i, test.namespace, test.name, test.interval, ca.warm)
+		}
+	}
+}
+
+func TestEarlyRefreshZonesSetup(t *testing.T) {
+	tests := []struct {
+		input        string
+		shouldErr    bool
+		earlyZones   []string
+		excludeZones []string
+	}{
+		{"", false, nil, nil},
+		{"earlyrefresh_zones example.org Example.NET.", false, []string{"example.org.", "example.net."}, nil},
+		{"earlyrefresh_exclude cluster.local", false, nil, []string{"cluster.local."}},
+		{"earlyrefresh_zones org\nearlyrefresh_exclude internal.example.org\nearlyrefresh_zones net", false, []string{"org.", "net."}, []string{"internal.example.org."}},
+		// negative
+		{"earlyrefresh_zones", true, nil, nil},
+		{"earlyrefresh_exclude", true, nil, nil},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", fmt.Sprintf("cache {\n%s\n}", test.input))
+		ca, err := cacheParse(c)
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %v: Expected error but found nil", i)
+			continue
+		} else if !test.shouldErr && err != nil {
+			t.Errorf("Test %v: Expected no error but found error: %v", i, err)
+			continue
+		}
+		if test.shouldErr {
+			continue
+		}
+		if !reflect.DeepEqual(ca.earlyZones, test.earlyZones) {
+			t.Errorf("Test %v: Expected earlyrefresh_zones %v but found: %v", i, test.earlyZones, ca.earlyZones)
+		}
+		if !reflect.DeepEqual(ca.excludeZones, test.excludeZones) {
+			t.Errorf("Test %v: Expected earlyrefresh_exclude %v but found: %v", i, test.excludeZones, ca.excludeZones)
+		}
+	}
+}
+
+func TestEarlyRefreshServiceAccountsSetup(t *testing.T) {
+	tests := []struct {
+		input           string
+		shouldErr       bool
+		serviceAccounts map[string]struct{}
+	}{
+		{"", false, nil},
+		{"early_refresh_service_accounts team-a/fqdn-controller", false, map[string]struct{}{"team-a/fqdn-controller": {}}},
+		{"early_refresh_service_accounts team-a/fqdn-controller team-b/default\nearly_refresh_service_accounts team-c/monitor", false, map[string]struct{}{"team-a/fqdn-controller": {}, "team-b/default": {}, "team-c/monitor": {}}},
+		// negative
+		{"early_refresh_service_accounts", true, nil},
+		{"early_refresh_service_accounts fqdn-controller", true, nil},
+		{"early_refresh_service_accounts team-a/", true, nil},
+		{"early_refresh_service_accounts /fqdn-controller", true, nil},
+		{"early_refresh_service_accounts a/b/c", true, nil},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", fmt.Sprintf("cache {\n%s\n}", test.input))
+		ca, err := cacheParse(c)
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %v: Expected error but found nil", i)
+			continue
+		} else if !test.shouldErr && err != nil {
+			t.Errorf("Test %v: Expected no error but found error: %v", i, err)
+			continue
+		}
+		if test.shouldErr {
+			continue
+		}
+		if !reflect.DeepEqual(ca.k8sAPI.serviceAccounts, test.serviceAccounts) {
+			t.Errorf("Test %v: Expected service accounts %v but found: %v", i, test.serviceAccounts, ca.k8sAPI.serviceAccounts)
+		}
+	}
+}
+
+func TestDetectIPCollisionsSetup(t *testing.T) {
+	tests := []struct {
+		input            string
+		shouldErr        bool
+		detectCollisions bool
+	}{
+		{"", false, false},
+		{"detect_ip_collisions", false, true},
+		// negative
+		{"detect_ip_collisions yes", true, false},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", fmt.Sprintf("cache {\n%s\n}", test.input))
+		ca, err := cacheParse(c)
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %v: Expected error but found nil", i)
+			continue
+		} else if !test.shouldErr && err != nil {
+			t.Errorf("Test %v: Expected no error but found error: %v", i, err)
+			continue
+		}
+		if test.shouldErr {
+			continue
+		}
+		if ca.k8sAPI.detectCollisions != test.detectCollisions {
+			t.Errorf("Test %v: Expected detect_ip_collisions %v but found: %v", i, test.detectCollisions, ca.k8sAPI.detectCollisions)
+		}
+	}
+}
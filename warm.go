@@ -0,0 +1,217 @@
+package cache
+
+import (
+	"bufio"
+	"context"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+
+	"github.com/miekg/dns"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	kcache "k8s.io/client-go/tools/cache"
+)
+
+const defaultWarmInterval = 5 * time.Second
+
+// warmQTypes are the query types that are kept warm for names listed without query types.
+var warmQTypes = []uint16{dns.TypeA, dns.TypeAAAA}
+
+// warmer keeps the names listed in a ConfigMap refreshed in the cache, regardless of queries. Each
+// value of the ConfigMap lists names, one per line, optionally followed by query types.
+type warmer struct {
+	namespace string
+	name      string
+	interval  time.Duration
+
+	informer kcache.SharedIndexInformer
+	stopChan chan struct{}
+	doneChan chan struct{}
+
+	mu    sync.RWMutex
+	names []warmName
+}
+
+// warmName is a name and query type that is kept warm.
+type warmName struct {
+	name  string
+	qtype uint16
+}
+
+func newWarmer(namespace, name string, interval time.Duration) *warmer {
+	return &warmer{namespace: namespace, name: name, interval: interval}
+}
+
+// startWarm starts watching the ConfigMap with the names to keep warm, and refreshing them every
+// c.warm.interval.
+func (c *Cache) startWarm() {
+	w := c.warm
+	w.stopChan = make(chan struct{})
+	w.doneChan = make(chan struct{})
+	w.watch(c.k8sAPI.client)
+	go func() {
+		defer close(w.doneChan)
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.stopChan:
+				return
+			case <-ticker.C:
+				c.refreshWarm(c.now().UTC())
+			}
+		}
+	}()
+}
+
+// stopWarm stops watching the ConfigMap and refreshing the names.
+func (c *Cache) stopWarm() {
+	if c.warm == nil || c.warm.stopChan == nil {
+		return
+	}
+	close(c.warm.stopChan)
+	<-c.warm.doneChan
+}
+
+// refreshWarm prefetches the names to keep warm that are not in the early cache, or would expire,
+// or reach the prefetch percentage, before the next run. It returns the number of prefetched names.
+func (c *Cache) refreshWarm(now time.Time) int {
+	n := 0
+	for _, wn := range c.warm.list() {
+		if plugin.Zones(c.Zones).Matches(wn.name) == "" {
+			continue
+		}
+		i := c.earlyItem(hash(wn.name, wn.qtype, false, false))
+		if i != nil {
+			threshold := int(math.Ceil(float64(c.percentage)/100*float64(i.origTTL)) + c.warm.interval.Seconds())
+			if i.ttl(now) > threshold {
+				continue
+			}
+		}
+		state := newRefreshRequest(wn.name, wn.qtype, false, false)
+		cw := newPrefetchResponseWriter("", state, c)
+		c.schedulePrefetch(context.Background(), state, cw, i, now, true)
+		warmRefreshes.Inc()
+		n++
+	}
+	return n
+}
+
+// list returns the names to keep warm.
+func (w *warmer) list() []warmName {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.names
+}
+
+// update replaces the names to keep warm with the names listed in cm. If cm is nil, no names are
+// kept warm.
+func (w *warmer) update(cm *v1.ConfigMap) {
+	var names []warmName
+	if cm != nil {
+		names = parseWarmNames(cm.Data)
+	}
+	w.mu.Lock()
+	w.names = names
+	w.mu.Unlock()
+	warmNames.Set(float64(len(names)))
+}
+
+// parseWarmNames returns the names listed in the values of data. Lines are formatted as
+// "NAME [QTYPE...]"; empty lines and lines starting with # are ignored.
+func parseWarmNames(data map[string]string) []warmName {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	seen := make(map[warmName]struct{})
+	var names []warmName
+	for _, k := range keys {
+		scanner := bufio.NewScanner(strings.NewReader(data[k]))
+		for scanner.Scan() {
+			f := strings.Fields(scanner.Text())
+			if len(f) == 0 || strings.HasPrefix(f[0], "#") {
+				continue
+			}
+			name := plugin.Name(f[0]).Normalize()
+			qtypes := warmQTypes
+			if len(f) > 1 {
+				qtypes = nil
+				for _, t := range f[1:] {
+					qtype, ok := dns.StringToType[strings.ToUpper(t)]
+					if !ok {
+						log.Warningf("Unknown query type %q for %s in keep_warm ConfigMap", t, name)
+						continue
+					}
+					qtypes = append(qtypes, qtype)
+				}
+			}
+			for _, qtype := range qtypes {
+				wn := warmName{name: name, qtype: qtype}
+				if _, ok := seen[wn]; ok {
+					continue
+				}
+				seen[wn] = struct{}{}
+				names = append(names, wn)
+			}
+		}
+	}
+	return names
+}
+
+// watch watches the ConfigMap w.namespace/w.name, and updates the names to keep warm when it
+// changes.
+func (w *warmer) watch(client kubernetes.Interface) {
+	selector := fields.OneTermEqualSelector("metadata.name", w.name)
+	lw := &kcache.ListWatch{
+		ListFunc:  configMapListFunc(context.Background(), client, w.namespace, selector),
+		WatchFunc: configMapWatchFunc(context.Background(), client, w.namespace, selector),
+	}
+	w.informer = kcache.NewSharedIndexInformer(lw, &v1.ConfigMap{}, defaultResyncPeriod, kcache.Indexers{})
+	w.informer.AddEventHandler(kcache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if cm, ok := obj.(*v1.ConfigMap); ok && cm.Name == w.name {
+				w.update(cm)
+			}
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			if cm, ok := obj.(*v1.ConfigMap); ok && cm.Name == w.name {
+				w.update(cm)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(kcache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if cm, ok := obj.(*v1.ConfigMap); ok && cm.Name == w.name {
+				w.update(nil)
+			}
+		},
+	})
+	go w.informer.Run(w.stopChan)
+}
+
+func configMapListFunc(ctx context.Context, c kubernetes.Interface, ns string, s fields.Selector) func(metav1.ListOptions) (runtime.Object, error) {
+	return func(opts metav1.ListOptions) (runtime.Object, error) {
+		opts.FieldSelector = s.String()
+		return c.CoreV1().ConfigMaps(ns).List(ctx, opts)
+	}
+}
+
+func configMapWatchFunc(ctx context.Context, c kubernetes.Interface, ns string, s fields.Selector) func(metav1.ListOptions) (watch.Interface, error) {
+	return func(opts metav1.ListOptions) (watch.Interface, error) {
+		opts.FieldSelector = s.String()
+		return c.CoreV1().ConfigMaps(ns).Watch(ctx, opts)
+	}
+}
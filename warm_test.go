@@ -0,0 +1,82 @@
+package cache
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseWarmNames(t *testing.T) {
+	tests := []struct {
+		data  map[string]string
+		names []warmName
+	}{
+		{nil, nil},
+		{map[string]string{"names": "example.org"}, []warmName{{"example.org.", dns.TypeA}, {"example.org.", dns.TypeAAAA}}},
+		{map[string]string{"names": "# comment\n\nExample.org. a mx\nexample.org A"}, []warmName{{"example.org.", dns.TypeA}, {"example.org.", dns.TypeMX}}},
+		{map[string]string{"b": "example.net AAAA", "a": "example.com BOGUS TXT"}, []warmName{{"example.com.", dns.TypeTXT}, {"example.net.", dns.TypeAAAA}}},
+	}
+	for i, tt := range tests {
+		if names := parseWarmNames(tt.data); !reflect.DeepEqual(names, tt.names) {
+			t.Errorf("Test %d: expected %v, got %v", i, tt.names, names)
+		}
+	}
+}
+
+func TestKeepWarm(t *testing.T) {
+	c := newTestK8sCache(true)
+	c.Next = ttlBackend(60)
+	client := c.k8sAPI.client
+	ctx := context.TODO()
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "warm", Namespace: "default"},
+		Data:       map[string]string{"names": "example.org A\nexample.net A"},
+	}
+	if _, err := client.CoreV1().ConfigMaps("default").Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	other := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "default"},
+		Data:       map[string]string{"names": "example.com"},
+	}
+	if _, err := client.CoreV1().ConfigMaps("default").Create(ctx, other, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	c.warm = newWarmer("default", "warm", time.Second)
+	c.warm.stopChan = make(chan struct{})
+	defer close(c.warm.stopChan)
+	c.warm.watch(client)
+	waitFor(t, "names to keep warm", func() bool { return len(c.warm.list()) == 2 })
+
+	// Not cached yet, refreshed without queries
+	if n := c.refreshWarm(time.Now()); n != 2 {
+		t.Errorf("Expected 2 refreshed names, got %d", n)
+	}
+	waitFor(t, "warm names in the cache", func() bool { return c.pcache.Len() == 2 && c.latepcache.Len() == 2 })
+	if n := c.refreshWarm(time.Now()); n != 0 {
+		t.Errorf("Expected no refreshed names while cached, got %d", n)
+	}
+	if n := c.refreshWarm(time.Now().Add(55 * time.Second)); n != 2 {
+		t.Errorf("Expected 2 refreshed names close to expiry, got %d", n)
+	}
+
+	cm.Data = map[string]string{"names": "example.org A"}
+	if _, err := client.CoreV1().ConfigMaps("default").Update(ctx, cm, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "updated names", func() bool { return len(c.warm.list()) == 1 })
+
+	if err := client.CoreV1().ConfigMaps("default").Delete(ctx, "warm", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "names to be removed", func() bool { return len(c.warm.list()) == 0 })
+	if n := c.refreshWarm(time.Now().Add(55 * time.Second)); n != 0 {
+		t.Errorf("Expected no refreshed names after deleting the ConfigMap, got %d", n)
+	}
+}